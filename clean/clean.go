@@ -45,10 +45,18 @@ func Nuke(cfg *models.Config, scope rune) {
 		log.Fatalf("Error generating Brivo access token: %s", err)
 	}
 
+	// Resolve the member groups and the barcode custom field for every scope
+	if err := config.LoadGroups(config.BrivoAPIKey, auth.BrivoToken.AccessToken); err != nil {
+		log.Fatalf("Error loading groups: %s", err)
+	}
+	if err := config.LoadCustomFields(config.BrivoAPIKey, auth.BrivoToken.AccessToken); err != nil {
+		log.Fatalf("Error loading custom fields: %s", err)
+	}
+
 	// Get Brivo users
 	if scope == '1' {
-		// Fetch from Member Group only
-		if err := brivo.ListUsersWithinGroup(config.BrivoMemberGroupID, config.BrivoAPIKey, auth.BrivoToken.AccessToken); err != nil {
+		// Fetch from Member Groups only
+		if err := listMembers(); err != nil {
 			log.Fatalln("Error fetching Brivo users", err)
 		}
 	} else if scope == '2' {
@@ -104,6 +112,34 @@ func Nuke(cfg *models.Config, scope rune) {
 	fmt.Println("Nuke completed. Check error logs for output.")
 }
 
+// Fetch users from each facility's Member groups. Users assigned to more than one group are only
+// included once. Staff users are skipped
+func listMembers() error {
+	var (
+		results []models.BrivoUser
+		seen    = make(map[int]bool)
+	)
+	for _, groupID := range config.MemberGroupIDs() {
+		var group models.Brivo
+		if err := group.ListUsersWithinGroup(groupID, config.BrivoAPIKey, auth.BrivoToken.AccessToken); err != nil {
+			return err
+		}
+		for _, user := range group.Data {
+			// Staff users are not members and should never be removed
+			if user.IsStaff() {
+				continue
+			}
+			if !seen[user.ID] {
+				seen[user.ID] = true
+				results = append(results, user)
+			}
+		}
+	}
+	brivo.Data = results
+	brivo.Count = len(results)
+	return nil
+}
+
 // Fetch the user's Barcode ID and delete the user from Brivo
 func processUser(user models.BrivoUser) {
 	wg.Add(1)
@@ -0,0 +1,53 @@
+// Failed Arrivals Report
+//
+// Use this application to list all client arrivals that
+// could not be logged to MINDBODY after retrying.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+
+	db "github.com/christophertino/mindbody-brivo"
+	"github.com/christophertino/mindbody-brivo/models"
+)
+
+func main() {
+	tenantKey := flag.String("tenant", "", "Tenant key (optional for single tenant setups)")
+	flag.Parse()
+
+	var env models.Config
+	env.GetConfig()
+
+	config, err := env.GetTenantConfig(*tenantKey)
+	if err != nil {
+		log.Fatalln("Error loading tenant:", err)
+	}
+
+	pool := db.NewPool(config.RedisURL)
+	defer pool.Close()
+
+	arrivals, err := models.FailedArrivals(config, pool)
+	if err != nil {
+		log.Fatalln("Error fetching failed arrivals:", err)
+	}
+
+	fmt.Println("---------- FAILED ARRIVALS ----------")
+	fmt.Println("Arrivals Not Logged:", len(arrivals))
+	for _, arrival := range arrivals {
+		fmt.Printf("External ID: %s Barcode ID: %s Occurred: %s Attempts: %d Reason: %s\n", arrival.ClientUniqueID, arrival.BarcodeID, arrival.Occurred.Format("2006-01-02 15:04:05"), arrival.Attempts, arrival.LastError)
+	}
+
+	reviews, err := models.ReviewArrivals(config, pool)
+	if err != nil {
+		log.Fatalln("Error fetching members marked for review:", err)
+	}
+
+	fmt.Println("---------- MEMBERS FOR REVIEW ----------")
+	fmt.Println("Members Marked For Review:", len(reviews))
+	for id, review := range reviews {
+		fmt.Printf("External ID: %s Reason: %s Message: %s\n", id, review.Reason, review.Message)
+	}
+}
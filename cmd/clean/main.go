@@ -7,6 +7,7 @@ package main
 
 import (
 	"bufio"
+	"flag"
 	"fmt"
 	"log"
 	"os"
@@ -16,8 +17,16 @@ import (
 )
 
 func main() {
-	var config models.Config
-	config.GetConfig()
+	tenantKey := flag.String("tenant", "", "Tenant key (optional for single tenant setups)")
+	flag.Parse()
+
+	var env models.Config
+	env.GetConfig()
+
+	config, err := env.GetTenantConfig(*tenantKey)
+	if err != nil {
+		log.Fatalln("Error loading tenant:", err)
+	}
 
 	fmt.Println("WARNING: This will delete all Brivo user data.")
 	fmt.Println("Enter [1] to delete Members only. Enter [2] to delete all users.")
@@ -31,7 +40,7 @@ func main() {
 	}
 
 	if char == '1' || char == '2' {
-		clean.Nuke(&config, char)
+		clean.Nuke(config, char)
 	} else {
 		fmt.Println("Input not recognized")
 	}
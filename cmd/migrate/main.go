@@ -6,14 +6,25 @@
 package main
 
 import (
+	"flag"
+	"log"
+
 	"github.com/christophertino/mindbody-brivo/migrate"
 	"github.com/christophertino/mindbody-brivo/models"
 )
 
 func main() {
-	var config models.Config
-	config.GetConfig()
+	tenantKey := flag.String("tenant", "", "Tenant key (optional for single tenant setups)")
+	flag.Parse()
+
+	var env models.Config
+	env.GetConfig()
+
+	config, err := env.GetTenantConfig(*tenantKey)
+	if err != nil {
+		log.Fatalln("Error loading tenant:", err)
+	}
 
 	// Sync all MINDBODY clients to Brivo
-	migrate.GetAllUsers(&config)
+	migrate.GetAllUsers(config)
 }
@@ -0,0 +1,30 @@
+// Brivo Reconciliation
+//
+// Use this application to sync all MINDBODY clients to Brivo,
+// updating existing users and their group memberships.
+
+package main
+
+import (
+	"flag"
+	"log"
+
+	"github.com/christophertino/mindbody-brivo/models"
+	"github.com/christophertino/mindbody-brivo/reconcile"
+)
+
+func main() {
+	tenantKey := flag.String("tenant", "", "Tenant key (optional for single tenant setups)")
+	flag.Parse()
+
+	var env models.Config
+	env.GetConfig()
+
+	config, err := env.GetTenantConfig(*tenantKey)
+	if err != nil {
+		log.Fatalln("Error loading tenant:", err)
+	}
+
+	// Sync all MINDBODY clients to Brivo
+	reconcile.Run(config)
+}
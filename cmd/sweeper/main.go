@@ -0,0 +1,47 @@
+// Membership Sweeper Report
+//
+// Use this application to list the results of the most
+// recent membership expiration sweeper runs.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+
+	db "github.com/christophertino/mindbody-brivo"
+	"github.com/christophertino/mindbody-brivo/models"
+)
+
+func main() {
+	tenantKey := flag.String("tenant", "", "Tenant key (optional for single tenant setups)")
+	flag.Parse()
+
+	var env models.Config
+	env.GetConfig()
+
+	config, err := env.GetTenantConfig(*tenantKey)
+	if err != nil {
+		log.Fatalln("Error loading tenant:", err)
+	}
+
+	pool := db.NewPool(config.RedisURL)
+	defer pool.Close()
+
+	summaries, err := models.SweepSummaries(config, pool)
+	if err != nil {
+		log.Fatalln("Error fetching sweeper runs:", err)
+	}
+
+	fmt.Println("---------- SWEEPER RUNS ----------")
+	for _, summary := range summaries {
+		fmt.Printf("Started: %s Finished: %s Checked: %d Suspended: %d Errors: %d\n", summary.Started.Format("2006-01-02 15:04:05"), summary.Finished.Format("2006-01-02 15:04:05"), summary.Checked, len(summary.Suspended), len(summary.Errors))
+		for id, reason := range summary.Suspended {
+			fmt.Printf("  Suspended External ID: %s Reason: %s\n", id, reason)
+		}
+		for id, reason := range summary.Errors {
+			fmt.Printf("  Error External ID: %s Reason: %s\n", id, reason)
+		}
+	}
+}
@@ -3,6 +3,7 @@
 package mindbodybrivo
 
 import (
+	"strings"
 	"time"
 
 	"github.com/gomodule/redigo/redis"
@@ -42,3 +43,177 @@ func Set(key string, value string, c redis.Conn) error {
 	}
 	return nil
 }
+
+// SetNX executes the Redis SET command with the NX and EX options. The key is
+// only set if it does not already exist and will expire after `ttl` seconds.
+// Returns true if the key was set.
+func SetNX(key string, value string, ttl int, c redis.Conn) (bool, error) {
+	_, err := redis.String(c.Do("SET", key, value, "NX", "EX", ttl))
+	if err == redis.ErrNil {
+		// Key already exists
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// SetEx executes the Redis SET command with the EX option. The key will expire after `ttl` seconds
+func SetEx(key string, value string, ttl int, c redis.Conn) error {
+	_, err := c.Do("SET", key, value, "EX", ttl)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// Exists executes the Redis EXISTS command. Returns true if the key exists
+func Exists(key string, c redis.Conn) (bool, error) {
+	exists, err := redis.Bool(c.Do("EXISTS", key))
+	if err != nil {
+		return false, err
+	}
+	return exists, nil
+}
+
+// Del executes the Redis DEL command
+func Del(key string, c redis.Conn) error {
+	_, err := c.Do("DEL", key)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// ZAdd executes the Redis ZADD command
+func ZAdd(key string, score int64, member string, c redis.Conn) error {
+	_, err := c.Do("ZADD", key, score, member)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// ZAddXX executes the Redis ZADD command with the XX and CH options. Only members that
+// already exist are updated. Returns true if the member's score was changed
+func ZAddXX(key string, score int64, member string, c redis.Conn) (bool, error) {
+	changed, err := redis.Int(c.Do("ZADD", key, "XX", "CH", score, member))
+	if err != nil {
+		return false, err
+	}
+	return changed == 1, nil
+}
+
+// Sets the member's score to ARGV[3] if its current score is at most ARGV[2]
+var zClaimScript = redis.NewScript(1, `
+local score = redis.call("ZSCORE", KEYS[1], ARGV[1])
+if score and tonumber(score) <= tonumber(ARGV[2]) then
+	redis.call("ZADD", KEYS[1], ARGV[3], ARGV[1])
+	return 1
+end
+return 0`)
+
+// ZClaim atomically moves a member whose score is at most `max` to `until`. Returns true
+// if the member was claimed. Only one client will receive true until the score reaches
+// `until` again, so items stay queued if the client crashes while processing them
+func ZClaim(key string, member string, max int64, until int64, c redis.Conn) (bool, error) {
+	claimed, err := redis.Int(zClaimScript.Do(c, key, member, max, until))
+	if err != nil {
+		return false, err
+	}
+	return claimed == 1, nil
+}
+
+// ZRangeByScore executes the Redis ZRANGEBYSCORE command and returns all members
+// with a score less than or equal to `max`
+func ZRangeByScore(key string, max int64, c redis.Conn) ([]string, error) {
+	values, err := redis.Strings(c.Do("ZRANGEBYSCORE", key, "-inf", max))
+	if err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+// ZScore executes the Redis ZSCORE command. Returns 0 if the member does not exist
+func ZScore(key string, member string, c redis.Conn) (int64, error) {
+	score, err := redis.Int64(c.Do("ZSCORE", key, member))
+	if err == redis.ErrNil {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return score, nil
+}
+
+// ZRem executes the Redis ZREM command. Returns true if the member was removed. Only one
+// client will receive true for the same member, so this can be used to claim queued items
+func ZRem(key string, member string, c redis.Conn) (bool, error) {
+	removed, err := redis.Int(c.Do("ZREM", key, member))
+	if err != nil {
+		return false, err
+	}
+	return removed == 1, nil
+}
+
+// HSet executes the Redis HSET command
+func HSet(key string, field string, value string, c redis.Conn) error {
+	_, err := c.Do("HSET", key, field, value)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// HGet executes the Redis HGET command
+func HGet(key string, field string, c redis.Conn) (string, error) {
+	value, err := redis.String(c.Do("HGET", key, field))
+	if err != nil {
+		return "", err
+	}
+	return value, nil
+}
+
+// HGetAll executes the Redis HGETALL command
+func HGetAll(key string, c redis.Conn) (map[string]string, error) {
+	values, err := redis.StringMap(c.Do("HGETALL", key))
+	if err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+// HDel executes the Redis HDEL command
+func HDel(key string, field string, c redis.Conn) error {
+	_, err := c.Do("HDEL", key, field)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// LPush executes the Redis LPUSH command and trims the list to `max` items
+func LPush(key string, value string, max int, c redis.Conn) error {
+	if _, err := c.Do("LPUSH", key, value); err != nil {
+		return err
+	}
+	if _, err := c.Do("LTRIM", key, 0, max-1); err != nil {
+		return err
+	}
+	return nil
+}
+
+// LRange executes the Redis LRANGE command and returns all items in the list
+func LRange(key string, c redis.Conn) ([]string, error) {
+	values, err := redis.Strings(c.Do("LRANGE", key, 0, -1))
+	if err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+// Key builds a namespaced Redis key from `parts`. Eg: arrival:12345
+func Key(parts ...string) string {
+	return strings.Join(parts, ":")
+}
@@ -13,6 +13,7 @@ import (
 	"github.com/beefsack/go-rate"
 	utils "github.com/christophertino/mindbody-brivo"
 	"github.com/christophertino/mindbody-brivo/models"
+	"github.com/gomodule/redigo/redis"
 )
 
 // Creates a log of users created/failed during migration
@@ -22,9 +23,17 @@ type outputLog struct {
 	failed  map[string]string
 }
 
+// Access decisions from the site's policies keyed by ExternalID
+type decisionSet struct {
+	access    sync.Mutex
+	decisions map[string]models.Decision
+}
+
 var (
 	auth         models.Auth
 	config       *models.Config
+	pool         *redis.Pool
+	decisions    decisionSet
 	brivo        models.Brivo
 	mb           models.MindBody
 	mu           sync.Mutex
@@ -39,10 +48,26 @@ var (
 func GetAllUsers(c *models.Config) {
 	config = c
 
+	// Used to schedule policy rechecks, such as for members on hold
+	pool = utils.NewPool(config.RedisURL)
+	defer pool.Close()
+
 	if err := auth.Authenticate(config); err != nil {
 		fmt.Println("Error generating AUTH tokens:", err)
 		return
 	}
+	if err := config.LoadCredentialFormat(config.BrivoAPIKey, auth.BrivoToken.AccessToken); err != nil {
+		fmt.Println("Error loading credential format:", err)
+		return
+	}
+	if err := config.LoadGroups(config.BrivoAPIKey, auth.BrivoToken.AccessToken); err != nil {
+		fmt.Println("Error loading groups:", err)
+		return
+	}
+	if err := config.LoadCustomFields(config.BrivoAPIKey, auth.BrivoToken.AccessToken); err != nil {
+		fmt.Println("Error loading custom fields:", err)
+		return
+	}
 
 	// Get all MINDBODY clients
 	wg.Add(1)
@@ -82,6 +107,7 @@ func createUsers() {
 
 	// Instantiate outputLog failed map
 	o.failed = make(map[string]string)
+	decisions.decisions = make(map[string]models.Decision)
 
 	// Iterate over all MINDBODY users
 	for i := range mb.Clients {
@@ -89,13 +115,20 @@ func createUsers() {
 		mbUser := mb.Clients[i]
 
 		// Validate that the ClientID has the correct facility access
-		if !models.IsValidID(config.BrivoFacilityCode, mbUser.ID) {
+		if _, ok := config.GetFacility(mbUser.ID); !ok {
 			// o.failed[mbUser.ID] = "Invalid ID format"
 			continue
 		}
 
-		// Convert MINDBODY user to Brivo user
+		// Convert MINDBODY user to Brivo user. Access and groups are decided by the site's policies
 		user.BuildUser(mbUser, *config)
+		decision, err := user.ApplyPolicies(mbUser, config, &auth, pool)
+		if err != nil {
+			o.failure(user.ExternalID, fmt.Sprintf("Apply Policies: %s", err.Error()))
+			fmt.Printf("Error applying policies for user %s with error: %s\n", user.ExternalID, err)
+			continue
+		}
+		decisions.set(user.ExternalID, decision)
 
 		// Check current refresh status
 		if !isRefreshing {
@@ -140,20 +173,49 @@ func processUser(user *models.BrivoUser) {
 		}
 
 		// Create a new credential
-		credID, err := createCredential(&u, barcodeID, config.BrivoFacilityCode)
+		barcode, err := config.ParseBarcode(barcodeID)
 		if err != nil {
 			fmt.Println(err)
 			return
 		}
+		if config.IssuesWristband() {
+			credID, err := createCredential(&u, barcode)
+			if err != nil {
+				fmt.Println(err)
+				return
+			}
 
-		// Assign the credential to the new user
-		if err := assignCredential(&u, credID); err != nil {
-			fmt.Println(err)
+			// Assign the credential to the new user
+			if err := assignCredential(&u, credID); err != nil {
+				fmt.Println(err)
+			}
 		}
 
-		// Assign the user to the Member's group
-		if err := assignGroup(&u); err != nil {
-			fmt.Println(err)
+		// Send a mobile pass invitation to the new user
+		if config.IssuesMobilePass() && !u.Suspended {
+			if err := issueMobilePass(&u); err != nil {
+				fmt.Println(err)
+			}
+		}
+
+		// Store the deny reason for the front desk and the fields set by the policies
+		decision := decisions.get(u.ExternalID)
+		if config.BrivoReasonFieldID != 0 && decision.Reason != "" {
+			if err := setCustomField(&u, config.BrivoReasonFieldID, decision.Reason); err != nil {
+				fmt.Println(err)
+			}
+		}
+		for fieldID, value := range decision.Fields {
+			if err := setCustomField(&u, fieldID, value); err != nil {
+				fmt.Println(err)
+			}
+		}
+
+		// Assign the user to the groups from the site's policies
+		for _, groupID := range decision.Groups {
+			if err := assignGroup(&u, groupID); err != nil {
+				fmt.Println(err)
+			}
 		}
 
 		o.success++
@@ -181,29 +243,40 @@ func createUser(user *models.BrivoUser) error {
 
 // Add custom fields for the user
 func updateCustomField(user *models.BrivoUser, customFieldID int) (string, error) {
-	rateLimit.Wait()
 	customFieldValue, err := models.GetFieldValue(customFieldID, user.CustomFields)
-	if err == nil {
-		err = user.UpdateCustomField(customFieldID, customFieldValue, config.BrivoAPIKey, auth.BrivoToken.AccessToken)
-		switch e := err.(type) {
-		case nil:
-			return customFieldValue, nil
-		case *utils.JSONError:
-			if e.Code == 401 {
-				errChan <- user
-				doRefresh()
-				return "", fmt.Errorf("Access token expired")
-			}
+	if err != nil {
+		o.failure(user.ExternalID, fmt.Sprintf("Update Custom Field ID %d: %s", customFieldID, err.Error()))
+		return "", fmt.Errorf("Error updating custom field ID %d for user %s with error: %s", customFieldID, user.ExternalID, err.Error())
+	}
+	return customFieldValue, setCustomField(user, customFieldID, customFieldValue)
+}
+
+// Set the value of a custom field for the user
+func setCustomField(user *models.BrivoUser, customFieldID int, value string) error {
+	rateLimit.Wait()
+	err := user.UpdateCustomField(customFieldID, value, config.BrivoAPIKey, auth.BrivoToken.AccessToken)
+	switch e := err.(type) {
+	case nil:
+		return nil
+	case *utils.JSONError:
+		if e.Code == 401 {
+			errChan <- user
+			doRefresh()
+			return fmt.Errorf("Access token expired")
 		}
 	}
 	o.failure(user.ExternalID, fmt.Sprintf("Update Custom Field ID %d: %s", customFieldID, err.Error()))
-	return "", fmt.Errorf("Error updating custom field ID %d for user %s with error: %s", customFieldID, user.ExternalID, err.Error())
+	return fmt.Errorf("Error updating custom field ID %d for user %s with error: %s", customFieldID, user.ExternalID, err.Error())
 }
 
 // Create new Brivo credential for this user
-func createCredential(user *models.BrivoUser, barcodeID string, facilityCode int) (int, error) {
+func createCredential(user *models.BrivoUser, barcode models.Barcode) (int, error) {
+	cred, err := config.CredentialGenerator.Generate(barcode)
+	if err != nil {
+		o.failure(user.ExternalID, fmt.Sprintf("Generate Credential: %s", err.Error()))
+		return 0, fmt.Errorf("Error generating credential for user %s with error: %s", user.ExternalID, err.Error())
+	}
 	rateLimit.Wait()
-	cred := models.GenerateStandardCredential(barcodeID, facilityCode)
 	rateLimit.Wait() // Add another count to the rate limit in case the credential exists and we need to make another call to fetch the ID
 	credID, err := cred.CreateCredential(config.BrivoAPIKey, auth.BrivoToken.AccessToken)
 	switch e := err.(type) {
@@ -220,6 +293,24 @@ func createCredential(user *models.BrivoUser, barcodeID string, facilityCode int
 	return 0, fmt.Errorf("Error creating credential for user %s with error: %s", user.ExternalID, err.Error())
 }
 
+// Send a mobile pass invitation to the user
+func issueMobilePass(user *models.BrivoUser) error {
+	rateLimit.Wait()
+	err := user.IssueMobilePass(config.BrivoAPIKey, auth.BrivoToken.AccessToken)
+	switch e := err.(type) {
+	case nil:
+		return nil
+	case *utils.JSONError:
+		if e.Code == 401 {
+			errChan <- user
+			doRefresh()
+			return fmt.Errorf("Access token expired")
+		}
+	}
+	o.failure(user.ExternalID, fmt.Sprintf("Issue Mobile Pass: %s", err.Error()))
+	return fmt.Errorf("Error issuing mobile pass for user %s with error: %s", user.ExternalID, err.Error())
+}
+
 // Assign credential to user
 func assignCredential(user *models.BrivoUser, credID int) error {
 	rateLimit.Wait()
@@ -239,9 +330,9 @@ func assignCredential(user *models.BrivoUser, credID int) error {
 }
 
 // Assign user to group
-func assignGroup(user *models.BrivoUser) error {
+func assignGroup(user *models.BrivoUser, groupID int) error {
 	rateLimit.Wait()
-	err := user.AssignUserGroup(config.BrivoMemberGroupID, config.BrivoAPIKey, auth.BrivoToken.AccessToken)
+	err := user.AssignUserGroup(groupID, config.BrivoAPIKey, auth.BrivoToken.AccessToken)
 	switch e := err.(type) {
 	case nil:
 		return nil
@@ -252,8 +343,8 @@ func assignGroup(user *models.BrivoUser) error {
 			return fmt.Errorf("Access token expired")
 		}
 	}
-	o.failure(user.ExternalID, fmt.Sprintf("Assign Group: %s", err.Error()))
-	return fmt.Errorf("Error assigning user %s to group with error: %s", user.ExternalID, err.Error())
+	o.failure(user.ExternalID, fmt.Sprintf("Assign Group %d: %s", groupID, err.Error()))
+	return fmt.Errorf("Error assigning user %s to group %d with error: %s", user.ExternalID, groupID, err.Error())
 }
 
 // Call Brivo and fetch a refreshed token
@@ -320,3 +411,16 @@ func (o *outputLog) printLog() {
 		log.Fatalln("Error writing output log", err)
 	}
 }
+
+// Uses mutual exclusion for thread-safe access to the decisions map[]
+func (set *decisionSet) set(userID string, decision models.Decision) {
+	set.access.Lock()
+	set.decisions[userID] = decision
+	set.access.Unlock()
+}
+
+func (set *decisionSet) get(userID string) models.Decision {
+	set.access.Lock()
+	defer set.access.Unlock()
+	return set.decisions[userID]
+}
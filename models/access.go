@@ -6,7 +6,6 @@ import (
 	"fmt"
 	"time"
 
-	db "github.com/christophertino/mindbody-brivo"
 	utils "github.com/christophertino/mindbody-brivo"
 	"github.com/gomodule/redigo/redis"
 )
@@ -18,6 +17,10 @@ type Access struct {
 		ID   int    `json:"id"`   // The user's Brivo ID
 		Name string `json:"name"` // The user's name (for debugging)
 	} `json:"actor"`
+	Site struct {
+		ID       int    `json:"id"`       // Brivo site ID
+		SiteName string `json:"siteName"` // Brivo site name (for debugging)
+	} `json:"site"`
 	EventData struct {
 		ActionAllowed bool               `json:"actionAllowed"` // Was the action allowed? (May not be used)
 		ObjectName    string             `json:"objectName"`    // Access point name
@@ -45,12 +48,9 @@ func (access *Access) ProcessRequest(config *Config, auth *Auth, pool *redis.Poo
 	}
 
 	// Check if the Brivo token needs to be refreshed
-	if time.Now().UTC().After(auth.BrivoToken.ExpireTime) {
-		if err := auth.BrivoToken.RefreshBrivoToken(*config); err != nil {
-			fmt.Println("Error refreshing Brivo AUTH token:\n", err)
-			return
-		}
-		utils.Logger("Refreshed Brivo AUTH token")
+	if err := auth.refreshBrivoToken(*config); err != nil {
+		fmt.Println(err)
+		return
 	}
 
 	// Fetch the user Credential by Brivo ID
@@ -60,50 +60,85 @@ func (access *Access) ProcessRequest(config *Config, auth *Auth, pool *redis.Poo
 		return
 	}
 
-	// Validate that the credential has the correct facility access
-	if !IsValidID(config.BrivoFacilityCode, cred.ReferenceID) {
-		utils.Logger(fmt.Sprintf("Credential %s is not a valid ID", cred.ReferenceID))
+	// Resolve the Brivo user that owns the credential. The user's ExternalID (MINDBODY
+	// UniqueID) is used for caching arrivals since the barcode ID can change
+	user, err := access.getUser(config.BrivoAPIKey, auth.BrivoToken.AccessToken)
+	if err != nil {
+		fmt.Printf("Error fetching Brivo user for credential %s\n%s\n", cred.ReferenceID, err)
 		return
 	}
 
-	// Add the request timestamp to Redis
-	now := time.Now().UTC().Format("2006-01-02 15:04:05")
-	timestamp, err := db.Get(cred.ReferenceID, conn)
-	utils.Logger(fmt.Sprintf("Redis: Fetch for key %s returned %s", cred.ReferenceID, timestamp))
-	if err == redis.ErrNil {
-		// Timestamp not found in Redis. Add current timestamp for the user
-		db.Set(cred.ReferenceID, now, conn)
-		timestamp = now
-		utils.Logger(fmt.Sprintf("Redis: Creating new key %s with timestamp %s", cred.ReferenceID, timestamp))
-	} else if err != nil {
-		utils.Logger(fmt.Sprintf("Redis: Fetch for key %s returned error %s", cred.ReferenceID, err))
+	// Resolve the MINDBODY barcode ID and validate that it has the correct facility access
+	barcodeID, err := user.getBarcodeID(cred, config, auth)
+	if err != nil {
+		utils.Logger(fmt.Sprintf("Credential %s is not a valid ID: %s", cred.ReferenceID, err))
 		return
-	} else {
-		// Don't log a Mindbody arrival for the user if we have seen them within the last 30min
-		if isActiveTimestamp(timestamp) {
-			utils.Logger(fmt.Sprintf("Redis: User %s already has an active Mindbody arrival timestamp", cred.ReferenceID))
-			return
-		}
-		// The user has an older arrival timestamp from a previous time. Update to current timestamp
-		db.Set(cred.ReferenceID, now, conn)
-		utils.Logger(fmt.Sprintf("Redis: Setting timestamp for existing key %s to %s", cred.ReferenceID, timestamp))
 	}
 
-	// Check if the Mindbody token needs to be refreshed
-	if time.Now().UTC().After(auth.MindBodyToken.ExpireTime) {
-		if err := auth.MindBodyToken.getMindBodyToken(*config); err != nil {
-			fmt.Println("Error refreshing Mindbody AUTH token:\n", err)
-			return
+	// Don't look anything up in MINDBODY if the user already has an arrival within the window.
+	// The arrival is still claimed with SET NX below, so concurrent scans are handled by Log
+	arrival := Arrival{
+		ClientUniqueID: user.ExternalID,
+		BarcodeID:      barcodeID,
+		Occurred:       access.Occurred,
+	}
+	if arrival.exists(config, conn) {
+		utils.Logger(fmt.Sprintf("User %s already has an active Mindbody arrival", user.ExternalID))
+		return
+	}
+
+	// Check if the Mindbody token needs to be refreshed. If MINDBODY is unavailable the
+	// default arrival window is used and the arrival will be queued for retry below
+	if err := auth.refreshMindBodyToken(*config); err != nil {
+		fmt.Println(err)
+	}
+
+	// The account balance is not checked here to keep MINDBODY lookups off the door. Queue
+	// the member to be synced again so an overdue balance suspends them after they enter
+	if config.findPolicy(PolicyBalance) != nil {
+		if err := scheduleRecheck(barcodeID, time.Now(), config, pool); err != nil {
+			fmt.Println(err)
 		}
-		utils.Logger("Refreshed Mindbody AUTH token")
 	}
 
 	// Log the user arrival in MINDBODY
-	err = AddArrival(cred.ReferenceID, config, auth.MindBodyToken.AccessToken)
+	window := access.getArrivalWindow(barcodeID, config, auth.MindBodyToken.AccessToken)
+	arrival.Window = int(window.Seconds())
+	err = arrival.Log(config, auth, conn)
+	switch err {
+	case nil:
+		utils.Logger(fmt.Sprintf("Logged arrival for user %s with arrival window %s", user.ExternalID, window))
+	case errArrivalExists:
+		utils.Logger(fmt.Sprintf("User %s already has an active Mindbody arrival", user.ExternalID))
+	default:
+		fmt.Printf("Error logging arrival to MINDBODY for user %s\n%s\n", barcodeID, err)
+		arrival.HandleError(err, config, auth, conn)
+	}
+}
+
+// Returns the MINDBODY barcode ID for the user's credential. Wristbands use the barcode ID
+// as their ReferenceID. Mobile passes and key fobs use the barcode ID stored on the user
+func (user *BrivoUser) getBarcodeID(cred Credential, config *Config, auth *Auth) (string, error) {
+	switch config.CredentialType(cred) {
+	case CredentialWristband:
+		return cred.ReferenceID, nil
+	case CredentialMobile, CredentialFob:
+	default:
+		return "", fmt.Errorf("Credential is not managed by the application")
+	}
+
+	var customFields CustomFields
+	if err := customFields.GetCustomFieldsForUser(user.ID, config.BrivoAPIKey, auth.BrivoToken.AccessToken); err != nil {
+		return "", fmt.Errorf("Error fetching custom fields for user %s: %s", user.ExternalID, err)
+	}
+	barcodeID, err := GetFieldValue(config.BrivoBarcodeFieldID, customFields.Data)
 	if err != nil {
-		fmt.Printf("Error logging arrival to MINDBODY for user %s\n%s", cred.ReferenceID, err)
-		return
+		return "", err
 	}
+	if _, ok := config.GetFacility(barcodeID); !ok {
+		return "", fmt.Errorf("Barcode ID %s of user %s is not valid", barcodeID, user.ExternalID)
+	}
+	return barcodeID, nil
 }
 
 // Unwraps the AccessCredential from the Access event
@@ -116,20 +151,50 @@ func (access *Access) getAccessCredential() (*AccessCredential, error) {
 	return &AccessCredential{}, fmt.Errorf("Access credential not found")
 }
 
-// Checks to see if the timestamp is active within the past 30min
-// @TODO: Make the timeout value an ENV property
-func isActiveTimestamp(timestamp string) bool {
-	now := time.Now().UTC()
-	lastVisit, err := time.Parse("2006-01-02 15:04:05", timestamp)
-	if err != nil {
-		fmt.Printf("Error parsing timestamp \n%s\n", err)
-		return false
+// Fetches the Brivo user from the Access event actor
+func (access *Access) getUser(brivoAPIKey string, brivoAccessToken string) (*BrivoUser, error) {
+	if access.Actor.ID == 0 {
+		return nil, fmt.Errorf("Access event does not have an actor")
+	}
+	var user BrivoUser
+	if err := user.getUserByID(access.Actor.ID, brivoAPIKey, brivoAccessToken); err != nil {
+		return nil, err
+	}
+	// Users without an ExternalID were not created from MINDBODY
+	if user.ExternalID == "" {
+		return nil, fmt.Errorf("Brivo user %d does not have an ExternalID", user.ID)
+	}
+	return &user, nil
+}
+
+// Returns how long an arrival should be cached for the user. Membership overrides take
+// precedence over site overrides, which take precedence over the default window. If the
+// user has more than one matching membership, the longest window is used.
+func (access *Access) getArrivalWindow(barcodeID string, config *Config, mbAccessToken string) time.Duration {
+	window := config.ArrivalWindow.Duration
+	if siteWindow, ok := config.ArrivalWindowSites[access.Site.ID]; ok {
+		window = siteWindow.Duration
+	}
+
+	// Only fetch memberships from MINDBODY if there are overrides to check against
+	if len(config.ArrivalWindowMemberships) == 0 {
+		return window
+	}
+	var memberships ClientMemberships
+	if err := memberships.GetActiveMemberships(barcodeID, config, mbAccessToken); err != nil {
+		fmt.Printf("Error fetching memberships for user %s. Using default arrival window\n%s\n", barcodeID, err)
+		return window
+	}
+	var membershipWindow time.Duration
+	for _, membership := range memberships.ClientMemberships {
+		if w, ok := config.ArrivalWindowMemberships[membership.Name]; ok && w.Duration > membershipWindow {
+			membershipWindow = w.Duration
+		}
 	}
-	// Has 30min passed since the last visit?
-	if now.Before(lastVisit.Add(time.Minute * 30)) {
-		return true
+	if membershipWindow > 0 {
+		return membershipWindow
 	}
-	return false
+	return window
 }
 
 // Checks to see if the timestamp matches the day, month and year of the current date
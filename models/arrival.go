@@ -0,0 +1,275 @@
+// MINDBODY Arrival Queue
+//
+// Arrivals are claimed in Redis before calling MINDBODY and the timestamp is
+// only committed once MINDBODY confirms the arrival. Failed arrivals are pushed
+// into a retry queue with exponential backoff. Arrivals that exceed the maximum
+// number of attempts are stored in a failed list for reporting.
+
+package models
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"time"
+
+	db "github.com/christophertino/mindbody-brivo"
+	utils "github.com/christophertino/mindbody-brivo"
+	"github.com/gomodule/redigo/redis"
+)
+
+// Arrival stores a client arrival that needs to be logged to MINDBODY
+type Arrival struct {
+	ClientUniqueID string    `json:"clientUniqueId"` // MINDBODY UniqueID (BrivoUser.ExternalID) used as the dedupe identity
+	BarcodeID      string    `json:"barcodeId"`      // MINDBODY barcode ID sent to AddArrival
+	Window         int       `json:"window"`         // Arrival window in seconds
+	Occurred       time.Time `json:"occurred"`       // Time of the original access event
+	Attempts       int       `json:"attempts"`
+	LastError      string    `json:"lastError"`
+}
+
+// Redis keys are namespaced to the tenant with Config.RedisKey
+const (
+	arrivalPending = "pending" // Value of the arrival key while MINDBODY is being called
+	retryQueue     = "retry"   // Sorted set of arrival IDs scored by next attempt time
+	retryJobs      = "jobs"    // Hash of arrival ID to Arrival json
+	failedList     = "failed"  // List of Arrival json that were never logged
+	failedListMax  = 1000      // Maximum number of failed arrivals to keep
+)
+
+// Time before a claimed arrival is retried by another process
+const retryLease = 5 * time.Minute
+
+// errArrivalExists is returned when an arrival has already been logged within the window
+var errArrivalExists = fmt.Errorf("Arrival already exists")
+
+// Log claims the arrival in Redis and logs it to MINDBODY. The arrival timestamp is
+// committed after MINDBODY confirms the arrival, otherwise the claim is released
+// so that the arrival can be retried.
+func (arrival *Arrival) Log(config *Config, auth *Auth, conn redis.Conn) error {
+	// Claim the arrival for the user. The key expires after the arrival window, so
+	// SET NX will only succeed once per window, even if scans happen concurrently
+	key := config.RedisKey("arrival", arrival.ClientUniqueID)
+	claimed, redisErr := db.SetNX(key, arrivalPending, arrival.Window, conn)
+	if redisErr != nil {
+		// Without Redis we can only proceed if MINDBODY visit history is used as a safeguard
+		if !config.MindbodyVerifyArrivals {
+			return fmt.Errorf("Redis: SET for key %s returned error %s", key, redisErr)
+		}
+		fmt.Printf("Redis: SET for key %s returned error %s. Falling back to MINDBODY visit history\n", key, redisErr)
+	} else if !claimed {
+		// Don't log a Mindbody arrival for the user if we have seen them within the arrival window
+		return errArrivalExists
+	}
+
+	// Check if the Mindbody token needs to be refreshed
+	if err := auth.refreshMindBodyToken(*config); err != nil {
+		arrival.release(key, conn)
+		return err
+	}
+
+	// Verify against MINDBODY that an arrival hasn't already been logged within the window
+	if config.MindbodyVerifyArrivals {
+		hasVisit, err := HasRecentVisit(arrival.BarcodeID, time.Duration(arrival.Window)*time.Second, config, auth.MindBodyToken.AccessToken)
+		if err != nil {
+			// Neither Redis or MINDBODY can confirm this is a new arrival
+			if redisErr != nil {
+				return fmt.Errorf("Error fetching MINDBODY visits: %s", err)
+			}
+			fmt.Printf("Error fetching MINDBODY visits for user %s\n%s\n", arrival.BarcodeID, err)
+		} else if hasVisit {
+			arrival.commit(key, conn)
+			return errArrivalExists
+		}
+	}
+
+	// Log the user arrival in MINDBODY
+	if err := AddArrival(arrival.BarcodeID, config, auth.MindBodyToken.AccessToken); err != nil {
+		if _, ok := err.(*ArrivalError); ok {
+			// MINDBODY rejected the arrival. Keep the claim so that follow-up actions
+			// only run once per arrival window
+			return err
+		}
+		arrival.release(key, conn)
+		return err
+	}
+	arrival.commit(key, conn)
+
+	return nil
+}
+
+// HandleError handles an error returned by Log. Arrivals rejected by MINDBODY run the
+// configured follow-up actions, all other errors are pushed into the retry queue
+func (arrival *Arrival) HandleError(arrivalErr error, config *Config, auth *Auth, conn redis.Conn) {
+	if e, ok := arrivalErr.(*ArrivalError); ok {
+		arrival.reject(e, config, auth, conn)
+		return
+	}
+	if err := arrival.Queue(arrivalErr, config, conn); err != nil {
+		fmt.Printf("Error queueing arrival for user %s: %s\n", arrival.ClientUniqueID, err)
+	}
+}
+
+// Queue pushes a failed arrival into the retry queue. If the arrival has reached the
+// maximum number of attempts it is moved to the failed list instead
+func (arrival *Arrival) Queue(arrivalErr error, config *Config, conn redis.Conn) error {
+	arrival.Attempts++
+	arrival.LastError = arrivalErr.Error()
+
+	if arrival.Attempts >= config.ArrivalRetryAttempts {
+		return arrival.fail(config, conn)
+	}
+
+	bytes, err := json.Marshal(arrival)
+	if err != nil {
+		return fmt.Errorf("Error building arrival json: %s", err)
+	}
+
+	// Exponential backoff: 1x, 2x, 4x, 8x...
+	backoff := config.ArrivalRetryBackoff.Duration * time.Duration(math.Pow(2, float64(arrival.Attempts-1)))
+	next := time.Now().UTC().Add(backoff)
+
+	// The job is keyed by arrival, so a later failed scan from the same user does not reset
+	// the attempts of a queued arrival. Once one of them is logged the others are skipped
+	// by the arrival window
+	if err := db.HSet(config.RedisKey("arrivals", retryJobs), arrival.id(), string(bytes), conn); err != nil {
+		return err
+	}
+	if err := db.ZAdd(config.RedisKey("arrivals", retryQueue), next.Unix(), arrival.id(), conn); err != nil {
+		return err
+	}
+
+	utils.Logger(fmt.Sprintf("Queued arrival for user %s. Attempt %d will run at %s", arrival.ClientUniqueID, arrival.Attempts+1, next))
+
+	return nil
+}
+
+// RetryArrivals processes all arrivals in the retry queue that are due
+func RetryArrivals(config *Config, auth *Auth, pool *redis.Pool) {
+	conn := pool.Get()
+	defer conn.Close()
+
+	now := time.Now().UTC()
+	ids, err := db.ZRangeByScore(config.RedisKey("arrivals", retryQueue), now.Unix(), conn)
+	if err != nil {
+		fmt.Printf("Redis: Error fetching arrival retry queue: %s\n", err)
+		return
+	}
+
+	for _, id := range ids {
+		// Claim the queued arrival. Another process may have already picked it up. The job
+		// stays queued until it is done, so it is retried after the lease if this process stops
+		claimed, err := db.ZClaim(config.RedisKey("arrivals", retryQueue), id, now.Unix(), now.Add(retryLease).Unix(), conn)
+		if err != nil || !claimed {
+			continue
+		}
+
+		value, err := db.HGet(config.RedisKey("arrivals", retryJobs), id, conn)
+		if err == redis.ErrNil {
+			// The job was completed but not removed from the queue
+			db.ZRem(config.RedisKey("arrivals", retryQueue), id, conn)
+			continue
+		}
+		if err != nil {
+			fmt.Printf("Redis: Error fetching queued arrival %s: %s\n", id, err)
+			continue
+		}
+
+		var arrival Arrival
+		if err := json.Unmarshal([]byte(value), &arrival); err != nil {
+			fmt.Printf("Error unmarshalling queued arrival %s: %s\n", id, err)
+			dequeueArrival(id, config, conn)
+			continue
+		}
+
+		err = arrival.Log(config, auth, conn)
+		switch err {
+		case nil:
+			fmt.Printf("Logged queued arrival for user %s after %d attempts\n", arrival.ClientUniqueID, arrival.Attempts+1)
+		case errArrivalExists:
+			utils.Logger(fmt.Sprintf("Queued arrival for user %s has already been logged", arrival.ClientUniqueID))
+		default:
+			fmt.Printf("Error logging queued arrival to MINDBODY for user %s\n%s\n", arrival.ClientUniqueID, err)
+			arrival.HandleError(err, config, auth, conn)
+			// Queue replaces the job with the next attempt unless it was moved to the failed list
+			if _, rejected := err.(*ArrivalError); !rejected && arrival.Attempts < config.ArrivalRetryAttempts {
+				continue
+			}
+		}
+		dequeueArrival(id, config, conn)
+	}
+}
+
+// Remove a completed arrival from the retry queue. The job is removed first, so a job
+// left in the queue is skipped by the next run
+func dequeueArrival(id string, config *Config, conn redis.Conn) {
+	if err := db.HDel(config.RedisKey("arrivals", retryJobs), id, conn); err != nil {
+		fmt.Printf("Redis: Error removing queued arrival %s: %s\n", id, err)
+		return
+	}
+	db.ZRem(config.RedisKey("arrivals", retryQueue), id, conn)
+}
+
+// FailedArrivals returns all arrivals that were never logged to MINDBODY
+func FailedArrivals(config *Config, pool *redis.Pool) ([]Arrival, error) {
+	conn := pool.Get()
+	defer conn.Close()
+
+	values, err := db.LRange(config.RedisKey("arrivals", failedList), conn)
+	if err != nil {
+		return nil, err
+	}
+
+	arrivals := make([]Arrival, 0, len(values))
+	for _, value := range values {
+		var arrival Arrival
+		if err := json.Unmarshal([]byte(value), &arrival); err != nil {
+			return nil, fmt.Errorf("Error unmarshalling failed arrival: %s", err)
+		}
+		arrivals = append(arrivals, arrival)
+	}
+
+	return arrivals, nil
+}
+
+// Returns the unique ID of the arrival. Eg: 100123-1565000000
+func (arrival *Arrival) id() string {
+	return fmt.Sprintf("%s-%d", arrival.ClientUniqueID, arrival.Occurred.Unix())
+}
+
+// Move the arrival to the failed list
+func (arrival *Arrival) fail(config *Config, conn redis.Conn) error {
+	bytes, err := json.Marshal(arrival)
+	if err != nil {
+		return fmt.Errorf("Error building arrival json: %s", err)
+	}
+	if err := db.LPush(config.RedisKey("arrivals", failedList), string(bytes), failedListMax, conn); err != nil {
+		return err
+	}
+	fmt.Printf("Arrival for user %s failed after %d attempts: %s\n", arrival.ClientUniqueID, arrival.Attempts, arrival.LastError)
+	return nil
+}
+
+// Returns true if an arrival has already been claimed or logged for the user within the
+// arrival window. Redis errors are left for Log to handle
+func (arrival *Arrival) exists(config *Config, conn redis.Conn) bool {
+	exists, err := db.Exists(config.RedisKey("arrival", arrival.ClientUniqueID), conn)
+	return err == nil && exists
+}
+
+// Commit the arrival timestamp once MINDBODY has confirmed the arrival
+func (arrival *Arrival) commit(key string, conn redis.Conn) {
+	now := time.Now().UTC().Format("2006-01-02 15:04:05")
+	if err := db.SetEx(key, now, arrival.Window, conn); err != nil {
+		fmt.Printf("Redis: Error committing arrival for key %s: %s\n", key, err)
+		return
+	}
+	utils.Logger(fmt.Sprintf("Redis: Set key %s to timestamp %s expiring in %ds", key, now, arrival.Window))
+}
+
+// Release the arrival claim so that the next scan is not suppressed
+func (arrival *Arrival) release(key string, conn redis.Conn) {
+	if err := db.Del(key, conn); err != nil {
+		fmt.Printf("Redis: Error releasing arrival for key %s: %s\n", key, err)
+	}
+}
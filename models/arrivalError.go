@@ -0,0 +1,198 @@
+// MINDBODY Arrival Business Errors
+//
+// MINDBODY rejects arrivals for distinct reasons, such as the client not having
+// a valid pricing option. These are parsed into an ArrivalError so that
+// configurable follow-up actions can be taken instead of retrying the arrival.
+
+package models
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	db "github.com/christophertino/mindbody-brivo"
+	utils "github.com/christophertino/mindbody-brivo"
+	"github.com/gomodule/redigo/redis"
+)
+
+// Reasons MINDBODY may reject an arrival
+const (
+	ArrivalNoPricingOption    = "no_pricing_option"
+	ArrivalClientNotFound     = "client_not_found"
+	ArrivalLocationNotAllowed = "location_not_allowed"
+	ArrivalRejected           = "rejected" // Any other business error
+)
+
+// Follow-up actions for a rejected arrival
+const (
+	actionAlert  = "alert"  // Add a yellow alert to the MINDBODY client
+	actionNotify = "notify" // POST a message to ArrivalNotifyURL for the front desk
+	actionReview = "review" // Mark the member for review in the failed arrivals report
+)
+
+const reviewList = "review" // Hash of ClientUniqueID to ArrivalError json
+
+// ArrivalError is returned when MINDBODY rejects an arrival for a business reason
+type ArrivalError struct {
+	Reason  string `json:"reason"`
+	Code    string `json:"code"`    // MINDBODY error code
+	Message string `json:"message"` // MINDBODY error message
+}
+
+// Render error message to string
+func (e *ArrivalError) Error() string {
+	return fmt.Sprintf("Arrival rejected (%s): %s %s", e.Reason, e.Code, e.Message)
+}
+
+// MINDBODY error codes mapped to rejection reasons
+var arrivalErrorCodes = map[string]string{
+	"clientnotfound":       ArrivalClientNotFound,
+	"invalidclient":        ArrivalClientNotFound,
+	"invalidclientid":      ArrivalClientNotFound,
+	"nopricingoption":      ArrivalNoPricingOption,
+	"novalidpricingoption": ArrivalNoPricingOption,
+	"invalidlocation":      ArrivalLocationNotAllowed,
+	"invalidlocationid":    ArrivalLocationNotAllowed,
+	"locationnotallowed":   ArrivalLocationNotAllowed,
+}
+
+// MINDBODY error messages mapped to rejection reasons, for errors with a generic code
+var arrivalErrorMessages = []struct {
+	phrase string
+	reason string
+}{
+	{"pricing option", ArrivalNoPricingOption},
+	{"client not found", ArrivalClientNotFound},
+	{"client does not exist", ArrivalClientNotFound},
+	{"not allowed at this location", ArrivalLocationNotAllowed},
+	{"not allowed at location", ArrivalLocationNotAllowed},
+	{"location not allowed", ArrivalLocationNotAllowed},
+	{"invalid location", ArrivalLocationNotAllowed},
+}
+
+// Parse a MINDBODY error response into an ArrivalError. Server errors, timeouts, rate
+// limiting and authorization errors are returned unchanged so that the arrival is retried.
+func parseArrivalError(err error) error {
+	e, ok := err.(*utils.JSONError)
+	if !ok || e.Code < 400 || e.Code == 401 || e.Code == 408 || e.Code == 429 || e.Code >= 500 {
+		return err
+	}
+
+	// MINDBODY errors use the format {"Error": {"Message": "", "Code": ""}}
+	body, ok := e.Body["Error"].(map[string]interface{})
+	if !ok {
+		return err
+	}
+	code, _ := body["Code"].(string)
+	message, _ := body["Message"].(string)
+
+	arrivalErr := ArrivalError{
+		Reason:  ArrivalRejected,
+		Code:    code,
+		Message: message,
+	}
+	if reason, ok := arrivalErrorCodes[strings.ToLower(code)]; ok {
+		arrivalErr.Reason = reason
+		return &arrivalErr
+	}
+	lower := strings.ToLower(message)
+	for _, m := range arrivalErrorMessages {
+		if strings.Contains(lower, m.phrase) {
+			arrivalErr.Reason = m.reason
+			break
+		}
+	}
+
+	return &arrivalErr
+}
+
+// Run the configured follow-up actions for a rejected arrival
+func (arrival *Arrival) reject(arrivalErr *ArrivalError, config *Config, auth *Auth, conn redis.Conn) {
+	fmt.Printf("MINDBODY rejected arrival for user %s\n%s\n", arrival.ClientUniqueID, arrivalErr)
+
+	// Keep a record of the arrival for the failed arrivals report
+	arrival.Attempts++
+	arrival.LastError = arrivalErr.Error()
+	if err := arrival.fail(config, conn); err != nil {
+		fmt.Printf("Error storing failed arrival for user %s: %s\n", arrival.ClientUniqueID, err)
+	}
+
+	for _, action := range config.ArrivalErrorActions[arrivalErr.Reason] {
+		var err error
+		switch action {
+		case actionAlert:
+			err = AddClientAlert(arrival.BarcodeID, fmt.Sprintf("Brivo arrival rejected: %s", arrivalErr.Message), config, auth.MindBodyToken.AccessToken)
+		case actionNotify:
+			err = arrival.notify(arrivalErr, config)
+		case actionReview:
+			err = arrival.review(arrivalErr, config, conn)
+		default:
+			err = fmt.Errorf("Action %s not found", action)
+		}
+		if err != nil {
+			fmt.Printf("Error running action %s for user %s: %s\n", action, arrival.ClientUniqueID, err)
+			continue
+		}
+		utils.Logger(fmt.Sprintf("Ran action %s for rejected arrival for user %s", action, arrival.ClientUniqueID))
+	}
+}
+
+// Post a message about the rejected arrival to the front desk notification URL
+func (arrival *Arrival) notify(arrivalErr *ArrivalError, config *Config) error {
+	if config.ArrivalNotifyURL == "" {
+		return fmt.Errorf("arrival_notify_url is not set")
+	}
+
+	// Slack compatible message format
+	bytesMessage, err := json.Marshal(map[string]string{
+		"text": fmt.Sprintf("MINDBODY rejected an arrival for client %s (%s): %s", arrival.BarcodeID, arrivalErr.Reason, arrivalErr.Message),
+	})
+	if err != nil {
+		return fmt.Errorf("Error building request body json: %s", err)
+	}
+
+	res, err := http.Post(config.ArrivalNotifyURL, "application/json", bytes.NewBuffer(bytesMessage))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode >= 400 {
+		return fmt.Errorf("Notification failed with status code %d", res.StatusCode)
+	}
+
+	return nil
+}
+
+// Mark the member for review
+func (arrival *Arrival) review(arrivalErr *ArrivalError, config *Config, conn redis.Conn) error {
+	data, err := json.Marshal(arrivalErr)
+	if err != nil {
+		return fmt.Errorf("Error building review json: %s", err)
+	}
+	return db.HSet(config.RedisKey("arrivals", reviewList), arrival.ClientUniqueID, string(data), conn)
+}
+
+// ReviewArrivals returns all members marked for review keyed by ClientUniqueID
+func ReviewArrivals(config *Config, pool *redis.Pool) (map[string]ArrivalError, error) {
+	conn := pool.Get()
+	defer conn.Close()
+
+	values, err := db.HGetAll(config.RedisKey("arrivals", reviewList), conn)
+	if err != nil {
+		return nil, err
+	}
+
+	reviews := make(map[string]ArrivalError)
+	for id, value := range values {
+		var arrivalErr ArrivalError
+		if err := json.Unmarshal([]byte(value), &arrivalErr); err != nil {
+			return nil, fmt.Errorf("Error unmarshalling review for user %s: %s", id, err)
+		}
+		reviews[id] = arrivalErr
+	}
+
+	return reviews, nil
+}
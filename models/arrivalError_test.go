@@ -0,0 +1,57 @@
+package models
+
+import (
+	"errors"
+	"testing"
+
+	utils "github.com/christophertino/mindbody-brivo"
+)
+
+func TestParseArrivalError(t *testing.T) {
+	mindbodyError := func(status int, code string, message string) error {
+		return &utils.JSONError{
+			Code: status,
+			Body: map[string]interface{}{
+				"Error": map[string]interface{}{"Code": code, "Message": message},
+			},
+		}
+	}
+
+	tests := []struct {
+		name   string
+		err    error
+		reason string // Empty if the error should be retried
+	}{
+		{"network error", errors.New("connection reset"), ""},
+		{"unauthorized", mindbodyError(401, "DeniedAccess", "Invalid token"), ""},
+		{"timeout", mindbodyError(408, "RequestTimeout", "Request timed out"), ""},
+		{"rate limited", mindbodyError(429, "TooManyRequests", "Rate limit exceeded"), ""},
+		{"server error", mindbodyError(503, "ServiceUnavailable", "Try again later"), ""},
+		{"no error body", &utils.JSONError{Code: 400, Body: map[string]interface{}{}}, ""},
+		{"client code", mindbodyError(400, "ClientNotFound", "Client 123 was not found"), ArrivalClientNotFound},
+		{"invalid client code", mindbodyError(400, "InvalidClientId", ""), ArrivalClientNotFound},
+		{"pricing option message", mindbodyError(400, "InvalidParameter", "Client does not have a valid pricing option"), ArrivalNoPricingOption},
+		{"location message", mindbodyError(400, "InvalidParameter", "Client is not allowed at this location"), ArrivalLocationNotAllowed},
+		{"location code", mindbodyError(400, "InvalidLocationId", "Location 2 is invalid"), ArrivalLocationNotAllowed},
+		{"unrelated location message", mindbodyError(400, "InvalidParameter", "LocationId is required for this arrival type"), ArrivalRejected},
+		{"other business error", mindbodyError(400, "InvalidParameter", "Arrival type is not valid"), ArrivalRejected},
+	}
+
+	for _, test := range tests {
+		err := parseArrivalError(test.err)
+		arrivalErr, ok := err.(*ArrivalError)
+		if test.reason == "" {
+			if ok {
+				t.Errorf("%s: expected error to be retried, got %s", test.name, arrivalErr)
+			}
+			continue
+		}
+		if !ok {
+			t.Errorf("%s: expected ArrivalError, got %v", test.name, err)
+			continue
+		}
+		if arrivalErr.Reason != test.reason {
+			t.Errorf("%s: expected reason %s, got %s", test.name, test.reason, arrivalErr.Reason)
+		}
+	}
+}
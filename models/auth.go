@@ -7,6 +7,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"sync"
 	"time"
 
 	utils "github.com/christophertino/mindbody-brivo"
@@ -16,6 +17,7 @@ import (
 type Auth struct {
 	BrivoToken    BrivoToken
 	MindBodyToken mbToken
+	mu            sync.Mutex // Webhooks and scheduled jobs refresh the same tokens
 }
 
 // BrivoToken stores Brivo API Tokens. Valid until `ExpiresIn` and then
@@ -72,6 +74,32 @@ func (auth *Auth) Authenticate(config *Config) error {
 	return nil
 }
 
+// Refresh the MINDBODY token if it has expired
+func (auth *Auth) refreshMindBodyToken(config Config) error {
+	auth.mu.Lock()
+	defer auth.mu.Unlock()
+	if time.Now().UTC().After(auth.MindBodyToken.ExpireTime) {
+		if err := auth.MindBodyToken.getMindBodyToken(config); err != nil {
+			return fmt.Errorf("Error refreshing Mindbody AUTH token: %s", err)
+		}
+		utils.Logger("Refreshed Mindbody AUTH token")
+	}
+	return nil
+}
+
+// Refresh the Brivo access token if it has expired
+func (auth *Auth) refreshBrivoToken(config Config) error {
+	auth.mu.Lock()
+	defer auth.mu.Unlock()
+	if time.Now().UTC().After(auth.BrivoToken.ExpireTime) {
+		if err := auth.BrivoToken.RefreshBrivoToken(config); err != nil {
+			return fmt.Errorf("Error refreshing Brivo AUTH token: %s", err)
+		}
+		utils.Logger("Refreshed Brivo AUTH token")
+	}
+	return nil
+}
+
 // Retrieve a MINDBODY Access Token
 func (token *mbToken) getMindBodyToken(config Config) error {
 	// Build request body JSON
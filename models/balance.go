@@ -0,0 +1,47 @@
+// Overdue Account Balances
+//
+// The `balance` policy denies access to members who owe more than
+// `mindbody_balance_threshold` or have a failed autopay. Overdue members are checked
+// again every `mindbody_balance_recheck` so that access is restored once the balance
+// is paid. Members who arrive at the facility are queued to be synced again, so a balance
+// that becomes overdue between webhooks is enforced after they enter.
+
+package models
+
+import (
+	"time"
+)
+
+// Denies access to members with an overdue account balance
+type balancePolicy struct{}
+
+func (balancePolicy) Name() string { return PolicyBalance }
+
+func (balancePolicy) Evaluate(client *ClientContext) (Decision, error) {
+	// Webhook events do not include the account balance
+	details, err := client.Details()
+	if err != nil {
+		return Decision{}, err
+	}
+
+	var decision Decision
+	if owed := -details.AccountBalance; owed > client.config.MindbodyBalanceThreshold {
+		decision = deny("Account balance of %.2f is past due", owed)
+	} else if client.config.MindbodyAutopayFailures {
+		contracts, err := client.Contracts()
+		if err != nil {
+			return Decision{}, err
+		}
+		for _, contract := range contracts {
+			if contract.AutopayStatus == "Failed" {
+				decision = deny("Autopay failed for contract %s", contract.ContractName)
+				break
+			}
+		}
+	}
+	if decision.Reason == "" {
+		return allow(), nil
+	}
+	decision.Recheck = time.Now().Add(client.config.MindbodyBalanceRecheck.Duration)
+	return decision, nil
+}
@@ -0,0 +1,95 @@
+// MINDBODY Barcode ID Parser
+//
+// Barcode IDs are validated with a configurable regular expression. The `card`
+// named group is required and holds the card number. The optional `facility`
+// named group holds the facility code. Eg: ^(?P<facility>[0-9]+)-(?P<card>[0-9]{5})$
+
+package models
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+)
+
+// Default barcode format of FACILITY_CODE-MEMBER_ID with a 5 digit card number
+const defaultBarcodePattern = `^(?P<facility>[0-9]+)-(?P<card>[0-9]{5})$`
+
+// Barcode stores the parts of a valid MINDBODY barcode ID
+type Barcode struct {
+	ID         string   // The full MINDBODY barcode ID (MindBodyUser.ID)
+	CardNumber string   // Card number used for the Brivo credential
+	Facility   Facility // Facility matching the barcode's facility code
+}
+
+// BarcodeParser validates MINDBODY barcode IDs and extracts the facility code and card number
+type BarcodeParser struct {
+	pattern             *regexp.Regexp
+	defaultFacilityCode int // Used when the pattern does not have a `facility` group
+}
+
+// NewBarcodeParser compiles the barcode pattern. The pattern must have a `card` named group
+func NewBarcodeParser(pattern string, defaultFacilityCode int) (*BarcodeParser, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid barcode pattern %s: %s", pattern, err)
+	}
+	if subexpIndex(re, "card") == -1 {
+		return nil, fmt.Errorf("Barcode pattern %s is missing the `card` named group", pattern)
+	}
+	return &BarcodeParser{
+		pattern:             re,
+		defaultFacilityCode: defaultFacilityCode,
+	}, nil
+}
+
+// Parse validates the barcode ID and returns the facility code and card number
+func (parser *BarcodeParser) Parse(barcodeID string) (int, string, error) {
+	match := parser.pattern.FindStringSubmatch(barcodeID)
+	if match == nil {
+		return 0, "", fmt.Errorf("Barcode ID %s does not match the barcode pattern", barcodeID)
+	}
+
+	cardNumber := match[subexpIndex(parser.pattern, "card")]
+	facilityCode := parser.defaultFacilityCode
+	if i := subexpIndex(parser.pattern, "facility"); i != -1 {
+		code, err := strconv.Atoi(match[i])
+		if err != nil {
+			return 0, "", fmt.Errorf("Barcode ID %s has an invalid facility code: %s", barcodeID, err)
+		}
+		facilityCode = code
+	}
+
+	return facilityCode, cardNumber, nil
+}
+
+// Returns the index of the named group in the pattern or -1 if it does not exist
+func subexpIndex(re *regexp.Regexp, name string) int {
+	for i, subexp := range re.SubexpNames() {
+		if subexp == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// ParseBarcode checks to make sure MindBodyUser.ID and EventUserData.ClientID follow
+// the configured barcode format and have a configured facility code. If the ID value
+// does not validate, that means the user has not been assigned a MINDBODY security
+// bracelet and should not be added to Brivo.
+func (config *Config) ParseBarcode(barcodeID string) (Barcode, error) {
+	facilityCode, cardNumber, err := config.BarcodeParser.Parse(barcodeID)
+	if err != nil {
+		return Barcode{}, err
+	}
+	for _, facility := range config.BrivoFacilities {
+		if facility.Code == facilityCode {
+			return Barcode{
+				ID:         barcodeID,
+				CardNumber: cardNumber,
+				Facility:   facility,
+			}, nil
+		}
+	}
+	return Barcode{}, fmt.Errorf("Barcode ID %s has facility code %d which is not configured", barcodeID, facilityCode)
+}
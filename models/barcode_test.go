@@ -0,0 +1,53 @@
+package models
+
+import "testing"
+
+func TestBarcodeParserParse(t *testing.T) {
+	tests := []struct {
+		name         string
+		pattern      string
+		barcodeID    string
+		facilityCode int
+		cardNumber   string
+		valid        bool
+	}{
+		{"default", defaultBarcodePattern, "12-34567", 12, "34567", true},
+		{"default short card", defaultBarcodePattern, "12-3456", 0, "", false},
+		{"default long card", defaultBarcodePattern, "12-345678", 0, "", false},
+		{"default missing facility", defaultBarcodePattern, "34567", 0, "", false},
+		{"default hex", defaultBarcodePattern, "0a1b2c3d", 0, "", false},
+		{"variable card", `^(?P<facility>[0-9]+)-(?P<card>[0-9]{5,6})$`, "14-345678", 14, "345678", true},
+		{"no facility group", `^(?P<card>[0-9]+)$`, "34567", 40, "34567", true},
+		{"no facility group invalid", `^(?P<card>[0-9]+)$`, "12-34567", 0, "", false},
+	}
+
+	for _, test := range tests {
+		parser, err := NewBarcodeParser(test.pattern, 40)
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		facilityCode, cardNumber, err := parser.Parse(test.barcodeID)
+		if !test.valid {
+			if err == nil {
+				t.Errorf("%s: expected %s to be invalid", test.name, test.barcodeID)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if facilityCode != test.facilityCode || cardNumber != test.cardNumber {
+			t.Errorf("%s: expected %d %s, got %d %s", test.name, test.facilityCode, test.cardNumber, facilityCode, cardNumber)
+		}
+	}
+}
+
+func TestNewBarcodeParserRequiresCard(t *testing.T) {
+	if _, err := NewBarcodeParser(`^(?P<facility>[0-9]+)-[0-9]{5}$`, 0); err == nil {
+		t.Error("expected pattern without a card group to be rejected")
+	}
+	if _, err := NewBarcodeParser(`^(?P<card>[0-9]+$`, 0); err == nil {
+		t.Error("expected invalid pattern to be rejected")
+	}
+}
@@ -0,0 +1,324 @@
+// Class and Appointment Booking Access Windows
+//
+// Members who only buy class packs are given access around their booked classes
+// and appointments. Each booking opens an access window from `class_access_before`
+// the start time until `class_access_after` the end time. Windows are stored in
+// Redis and a scheduled job assigns and removes the Brivo class group.
+
+package models
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	db "github.com/christophertino/mindbody-brivo"
+	utils "github.com/christophertino/mindbody-brivo"
+	"github.com/gomodule/redigo/redis"
+)
+
+const (
+	bookingList    = "bookings" // Hash of booking ID to accessWindow json
+	bookingStarts  = "start"    // Sorted set of booking IDs scored by window start
+	bookingEnds    = "end"      // Sorted set of booking IDs scored by window end
+	bookingClients = "clients"  // Sorted set of MINDBODY UniqueIDs scored by the end of their last window
+)
+
+// Booking stores MINDBODY class roster and appointment booking data sent by webhook events
+type Booking struct {
+	SiteID               int    `json:"siteId"`
+	ClassRosterBookingID int    `json:"classRosterBookingId"`
+	ClassStartDateTime   string `json:"classStartDateTime"`
+	ClassEndDateTime     string `json:"classEndDateTime"`
+	AppointmentID        int    `json:"appointmentId"`
+	StartDateTime        string `json:"startDateTime"`
+	EndDateTime          string `json:"endDateTime"`
+	ClientID             string `json:"clientId"`
+	ClientUniqueID       int    `json:"clientUniqueId"`
+}
+
+// Access window stored for each booking
+type accessWindow struct {
+	UserID int   `json:"userId"` // Brivo user ID
+	Start  int64 `json:"start"`
+	End    int64 `json:"end"`
+}
+
+// Returns the unique key for the booking. Eg: class-1234 or appointment-5678
+func (booking *Booking) key() string {
+	if booking.ClassRosterBookingID != 0 {
+		return fmt.Sprintf("class-%d", booking.ClassRosterBookingID)
+	}
+	return fmt.Sprintf("appointment-%d", booking.AppointmentID)
+}
+
+// Returns the start and end time of the class or appointment
+func (booking *Booking) times(config *Config) (time.Time, time.Time, error) {
+	start, end := booking.StartDateTime, booking.EndDateTime
+	if booking.ClassRosterBookingID != 0 {
+		start, end = booking.ClassStartDateTime, booking.ClassEndDateTime
+	}
+	startTime, err := config.parseMindBodyTime(start)
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("Invalid booking start time %s: %s", start, err)
+	}
+	endTime, err := config.parseMindBodyTime(end)
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("Invalid booking end time %s: %s", end, err)
+	}
+	return startTime, endTime, nil
+}
+
+// ProcessBooking is a webhook event handler for classRosterBooking.created and
+// appointmentBooking.created. Opens an access window around the booking
+func (event *Event) ProcessBooking(tenant *Tenant) error {
+	config := tenant.Config
+	auth := &tenant.Auth
+	if config.BrivoClassGroupID == 0 {
+		return nil
+	}
+
+	var booking Booking
+	if err := json.Unmarshal(event.RawEventData, &booking); err != nil {
+		return fmt.Errorf("Error parsing booking data: %s", err)
+	}
+	start, end, err := booking.times(config)
+	if err != nil {
+		return err
+	}
+	window := accessWindow{
+		Start: start.Add(-config.ClassAccessBefore.Duration).UTC().Unix(),
+		End:   end.Add(config.ClassAccessAfter.Duration).UTC().Unix(),
+	}
+	if window.End <= time.Now().UTC().Unix() {
+		utils.Logger(fmt.Sprintf("Booking %s has already ended", booking.key()))
+		return nil
+	}
+
+	// Webhook events may not include the client's unique ID
+	if booking.ClientUniqueID == 0 {
+		if err := auth.refreshMindBodyToken(*config); err != nil {
+			return err
+		}
+		mbUser, err := GetClient(booking.ClientID, config, auth.MindBodyToken.AccessToken)
+		if err != nil {
+			return fmt.Errorf("Error fetching MINDBODY client %s: %s", booking.ClientID, err)
+		}
+		booking.ClientUniqueID = mbUser.UniqueID
+	}
+
+	var user BrivoUser
+	err = user.getUserByExternalID(strconv.Itoa(booking.ClientUniqueID), config.BrivoAPIKey, auth.BrivoToken.AccessToken)
+	switch e := err.(type) {
+	case nil:
+	case *utils.JSONError:
+		// Unauthorized: Invalid token
+		if e.Code == 401 {
+			return fmt.Errorf("%d", http.StatusUnauthorized)
+		}
+		return fmt.Errorf("Brivo user %d does not exist. Error: %s", booking.ClientUniqueID, err)
+	default:
+		return err
+	}
+	window.UserID = user.ID
+
+	data, err := json.Marshal(window)
+	if err != nil {
+		return fmt.Errorf("Error building access window json: %s", err)
+	}
+
+	conn := tenant.Pool.Get()
+	defer conn.Close()
+
+	id := booking.key()
+	if err := db.HSet(config.RedisKey(bookingList), id, string(data), conn); err != nil {
+		return fmt.Errorf("Redis: Error storing booking %s: %s", id, err)
+	}
+	if err := db.ZAdd(config.RedisKey(bookingList, bookingStarts), window.Start, id, conn); err != nil {
+		return fmt.Errorf("Redis: Error storing booking %s: %s", id, err)
+	}
+	if err := db.ZAdd(config.RedisKey(bookingList, bookingEnds), window.End, id, conn); err != nil {
+		return fmt.Errorf("Redis: Error storing booking %s: %s", id, err)
+	}
+
+	// Class-pack clients are not active members, so the status policy keeps them suspended
+	// unless they have a booking. Keep the later end if the client has another booking
+	clientsKey := config.RedisKey(bookingList, bookingClients)
+	clientID := strconv.Itoa(booking.ClientUniqueID)
+	current, err := db.ZScore(clientsKey, clientID, conn)
+	if err != nil {
+		return fmt.Errorf("Redis: Error fetching bookings for user %s: %s", user.ExternalID, err)
+	}
+	if window.End > current {
+		if err := db.ZAdd(clientsKey, window.End, clientID, conn); err != nil {
+			return fmt.Errorf("Redis: Error storing bookings for user %s: %s", user.ExternalID, err)
+		}
+	}
+	if err := scheduleRecheck(booking.ClientID, time.Now(), config, tenant.Pool); err != nil {
+		return err
+	}
+
+	fmt.Printf("Brivo user %s has access for booking %s from %s to %s\n", user.ExternalID, id,
+		time.Unix(window.Start, 0).Format(time.RFC3339), time.Unix(window.End, 0).Format(time.RFC3339))
+	return nil
+}
+
+// Returns the end of the client's last booking access window. Returns a zero time if
+// the client does not have a booking
+func bookedUntil(clientUniqueID int, config *Config, pool *redis.Pool) (time.Time, error) {
+	conn := pool.Get()
+	defer conn.Close()
+
+	end, err := db.ZScore(config.RedisKey(bookingList, bookingClients), strconv.Itoa(clientUniqueID), conn)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("Redis: Error fetching bookings for user %d: %s", clientUniqueID, err)
+	}
+	if end == 0 {
+		return time.Time{}, nil
+	}
+	return time.Unix(end, 0), nil
+}
+
+// CancelBooking is a webhook event handler for classRosterBooking.cancelled and
+// appointmentBooking.cancelled. Removes the booking's access window
+func (event *Event) CancelBooking(tenant *Tenant) error {
+	config := tenant.Config
+	if config.BrivoClassGroupID == 0 {
+		return nil
+	}
+
+	var booking Booking
+	if err := json.Unmarshal(event.RawEventData, &booking); err != nil {
+		return fmt.Errorf("Error parsing booking data: %s", err)
+	}
+
+	conn := tenant.Pool.Get()
+	defer conn.Close()
+
+	// If the window has not opened yet it can be removed without changing the user's groups.
+	// ZREM only succeeds once, so the scheduled job cannot open the window at the same time
+	id := booking.key()
+	notStarted, err := db.ZRem(config.RedisKey(bookingList, bookingStarts), id, conn)
+	if err != nil {
+		return fmt.Errorf("Redis: Error removing booking %s: %s", id, err)
+	}
+	if notStarted {
+		db.ZRem(config.RedisKey(bookingList, bookingEnds), id, conn)
+		db.HDel(config.RedisKey(bookingList), id, conn)
+		fmt.Printf("Removed access window for cancelled booking %s\n", id)
+		return nil
+	}
+
+	// The window has opened. End it now and let the scheduled job close it, so that the class
+	// group is only changed by one process
+	ended, err := db.ZAddXX(config.RedisKey(bookingList, bookingEnds), time.Now().UTC().Unix(), id, conn)
+	if err != nil {
+		return fmt.Errorf("Redis: Error ending booking %s: %s", id, err)
+	}
+	if !ended {
+		utils.Logger(fmt.Sprintf("Booking %s does not have an access window", id))
+		return nil
+	}
+
+	fmt.Printf("Ended access window for cancelled booking %s\n", id)
+	return nil
+}
+
+// UpdateAccessWindows assigns the class group to users whose access windows have
+// opened and removes it from users whose access windows have closed
+func UpdateAccessWindows(config *Config, auth *Auth, pool *redis.Pool) {
+	conn := pool.Get()
+	defer conn.Close()
+
+	now := time.Now().UTC().Unix()
+
+	// Open access windows
+	ids, err := db.ZRangeByScore(config.RedisKey(bookingList, bookingStarts), now, conn)
+	if err != nil {
+		fmt.Printf("Redis: Error fetching booking access windows: %s\n", err)
+		return
+	}
+	for _, id := range ids {
+		claimed, err := db.ZRem(config.RedisKey(bookingList, bookingStarts), id, conn)
+		if err != nil || !claimed {
+			continue
+		}
+		window, err := getAccessWindow(id, config, conn)
+		if err != nil {
+			fmt.Printf("Redis: Error fetching booking %s: %s\n", id, err)
+			continue
+		}
+		user := BrivoUser{ID: window.UserID}
+		if err := user.AssignUserGroup(config.BrivoClassGroupID, config.BrivoAPIKey, auth.BrivoToken.AccessToken); err != nil {
+			fmt.Printf("Error assigning user %d to group %d: %s\n", window.UserID, config.BrivoClassGroupID, err)
+			// Try again on the next run
+			db.ZAdd(config.RedisKey(bookingList, bookingStarts), now, id, conn)
+			continue
+		}
+		utils.Logger(fmt.Sprintf("Opened access window for booking %s", id))
+	}
+
+	// Close access windows
+	ids, err = db.ZRangeByScore(config.RedisKey(bookingList, bookingEnds), now, conn)
+	if err != nil {
+		fmt.Printf("Redis: Error fetching booking access windows: %s\n", err)
+		return
+	}
+	for _, id := range ids {
+		claimed, err := db.ZRem(config.RedisKey(bookingList, bookingEnds), id, conn)
+		if err != nil || !claimed {
+			continue
+		}
+		window, err := getAccessWindow(id, config, conn)
+		if err != nil {
+			fmt.Printf("Redis: Error fetching booking %s: %s\n", id, err)
+			continue
+		}
+		db.HDel(config.RedisKey(bookingList), id, conn)
+		if err := closeAccessWindow(window, config, auth, conn); err != nil {
+			fmt.Printf("Error closing access window for booking %s: %s\n", id, err)
+			continue
+		}
+		utils.Logger(fmt.Sprintf("Closed access window for booking %s", id))
+	}
+}
+
+// Fetch the access window for the booking ID
+func getAccessWindow(id string, config *Config, conn redis.Conn) (accessWindow, error) {
+	var window accessWindow
+	value, err := db.HGet(config.RedisKey(bookingList), id, conn)
+	if err != nil {
+		return window, err
+	}
+	if err := json.Unmarshal([]byte(value), &window); err != nil {
+		return window, fmt.Errorf("Error unmarshalling booking %s: %s", id, err)
+	}
+	return window, nil
+}
+
+// Remove the user from the class group unless they have another open access window.
+// The window must already be removed from Redis
+func closeAccessWindow(window accessWindow, config *Config, auth *Auth, conn redis.Conn) error {
+	windows, err := db.HGetAll(config.RedisKey(bookingList), conn)
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC().Unix()
+	for _, value := range windows {
+		var w accessWindow
+		if err := json.Unmarshal([]byte(value), &w); err != nil {
+			continue
+		}
+		if w.UserID == window.UserID && w.Start <= now && w.End > now {
+			return nil
+		}
+	}
+
+	user := BrivoUser{ID: window.UserID}
+	if err := user.RemoveUserGroup(config.BrivoClassGroupID, config.BrivoAPIKey, auth.BrivoToken.AccessToken); err != nil {
+		return fmt.Errorf("Error removing user %d from group %d: %s", window.UserID, config.BrivoClassGroupID, err)
+	}
+	return nil
+}
@@ -28,7 +28,7 @@ type BrivoUser struct {
 	MiddleName   string        `json:"middleName"`
 	LastName     string        `json:"lastName"`
 	Suspended    bool          `json:"suspended"`
-	CustomFields []CustomField `json:"customFields"`
+	CustomFields []CustomField `json:"customFields,omitempty"`
 	Emails       []email       `json:"emails"`
 	PhoneNumbers []phoneNumber `json:"phoneNumbers"`
 }
@@ -128,13 +128,13 @@ func (brivo *Brivo) ListUsersWithinGroup(groupID int, brivoAPIKey string, brivoA
 	return nil
 }
 
-// BuildUser will build a Brivo user from MINDBODY user data
+// BuildUser will build a Brivo user from MINDBODY user data. The suspended status
+// is decided by the site's access policies
 func (user *BrivoUser) BuildUser(mbUser MindBodyUser, config Config) {
 	user.ExternalID = strconv.Itoa(mbUser.UniqueID)
 	user.FirstName = mbUser.FirstName
 	user.MiddleName = mbUser.MiddleName
 	user.LastName = mbUser.LastName
-	user.Suspended = (mbUser.Active == false || mbUser.Status != "Active")
 	if mbUser.Email != "" {
 		user.Emails = append(user.Emails, email{
 			Address:   mbUser.Email,
@@ -162,7 +162,7 @@ func (user *BrivoUser) BuildUser(mbUser MindBodyUser, config Config) {
 
 	// Create custom fields for MINDBODY barcodeID and user type
 	barcodeID := GenerateCustomField(config.BrivoBarcodeFieldID, mbUser.ID)
-	userType := GenerateCustomField(config.BrivoUserTypeFieldID, "Member")
+	userType := GenerateCustomField(config.BrivoUserTypeFieldID, UserTypeMember)
 	user.CustomFields = append(user.CustomFields, *barcodeID, *userType)
 }
 
@@ -262,6 +262,25 @@ func (user *BrivoUser) AssignUserGroup(groupID int, brivoAPIKey string, brivoAcc
 	return nil
 }
 
+// RemoveUserGroup removes the user from groupID
+func (user *BrivoUser) RemoveUserGroup(groupID int, brivoAPIKey string, brivoAccessToken string) error {
+	// Create HTTP request
+	req, err := http.NewRequest("DELETE", fmt.Sprintf("https://api.brivo.com/v1/api/groups/%d/users/%d", groupID, user.ID), nil)
+	if err != nil {
+		return fmt.Errorf("Error creating HTTP request: %s", err)
+	}
+	req.Header.Add("Content-Type", "application/json")
+	req.Header.Add("Authorization", "Bearer "+brivoAccessToken)
+	req.Header.Add("api-key", brivoAPIKey)
+
+	var r map[string]interface{}
+	if err = utils.DoRequest(req, &r); err != nil {
+		return err
+	}
+
+	return nil
+}
+
 // Retrieves a Brivo user by their unique Brivo ID value
 func (user *BrivoUser) getUserByID(brivoID int, brivoAPIKey string, brivoAccessToken string) error {
 	// Create HTTP request
@@ -281,9 +300,9 @@ func (user *BrivoUser) getUserByID(brivoID int, brivoAPIKey string, brivoAccessT
 }
 
 // Retrieves a Brivo user by their ExternalID value
-func (user *BrivoUser) getUserByExternalID(externalID int, brivoAPIKey string, brivoAccessToken string) error {
+func (user *BrivoUser) getUserByExternalID(externalID string, brivoAPIKey string, brivoAccessToken string) error {
 	// Create HTTP request
-	req, err := http.NewRequest("GET", fmt.Sprintf("https://api.brivo.com/v1/api/users/%d/external", externalID), nil)
+	req, err := http.NewRequest("GET", fmt.Sprintf("https://api.brivo.com/v1/api/users/%s/external", externalID), nil)
 	if err != nil {
 		return fmt.Errorf("Error creating HTTP request: %s", err)
 	}
@@ -300,8 +319,13 @@ func (user *BrivoUser) getUserByExternalID(externalID int, brivoAPIKey string, b
 
 // Update an existing Brivo user
 func (user *BrivoUser) updateUser(brivoAPIKey string, brivoAccessToken string) error {
+	// Custom fields are updated one at a time with UpdateCustomField, so they are left out
+	// of the request body to avoid replacing fields that are not set on `user`
+	body := *user
+	body.CustomFields = nil
+
 	// Build request body JSON
-	bytesMessage, err := json.Marshal(user)
+	bytesMessage, err := json.Marshal(body)
 	if err != nil {
 		return fmt.Errorf("Error building request body json: %s", err)
 	}
@@ -4,15 +4,21 @@ package models
 
 import (
 	"encoding/base64"
+	"encoding/json"
+	"fmt"
 	"log"
 	"os"
 	"strconv"
+	"time"
 
+	db "github.com/christophertino/mindbody-brivo"
 	"github.com/joho/godotenv"
 )
 
 // Config stores environment settings imported from .env
 type Config struct {
+	TenantKey string // Unique key for the tenant. Empty when running a single tenant
+
 	BrivoUsername          string
 	BrivoPassword          string
 	BrivoClientID          string
@@ -23,8 +29,36 @@ type Config struct {
 	BrivoMemberGroupID     int
 	BrivoBarcodeFieldID    int
 	BrivoUserTypeFieldID   int
+	BrivoReasonFieldID     int
+	BrivoHouseholdFieldID  int
 	BrivoRateLimit         int
 	BrivoClientCredentials string
+	BrivoStaffGroupID      int
+	BrivoGuestGroupID      int
+	BrivoClassGroupID      int
+	BrivoMinorGroupID      int
+	BrivoMemberGroupName   string         // Used to find the member group when brivo_member_group_id is not set
+	BrivoBarcodeFieldName  string         // Used to find the barcode field when brivo_barcode_field_id is not set
+	BrivoUserTypeFieldName string         // Used to find the user type field when brivo_user_type_field_id is not set
+	BrivoFacilities        []Facility     // Facility codes mapped to credential facility codes and groups
+	BrivoGroupRules        []GroupRule    // MINDBODY memberships, contracts and client indexes mapped to groups
+	BrivoFieldMappings     []FieldMapping // MINDBODY client fields copied into Brivo custom fields
+
+	BarcodeParser       *BarcodeParser      // Validates MINDBODY barcode IDs
+	CredentialGenerator CredentialGenerator // Creates Brivo credentials from barcodes
+	BrivoMobilePass     string              // Issue mobile passes: off, alongside or only
+	AccessPolicies      []Policy            // Access eligibility policies evaluated in order
+
+	CredentialContractDates bool // Set credential effective-to dates from MINDBODY contracts
+
+	StaffSyncInterval Duration            // Time between MINDBODY staff syncs
+	GuestProducts     map[string]Duration // Guest access duration keyed by MINDBODY product ID or name
+	ClassAccessBefore Duration            // Access before a booked class or appointment starts
+	ClassAccessAfter  Duration            // Access after a booked class or appointment ends
+	MinorAge          int                 // Members younger than this age are minors. 0 disables minor access rules
+
+	SweeperInterval          Duration // Time between membership expiration sweeps. 0 disables the sweeper
+	SweeperRequireMembership bool     // Also suspend active clients without an active MINDBODY membership
 
 	MindbodyAPIKey              string
 	MindbodyUsername            string
@@ -32,6 +66,27 @@ type Config struct {
 	MindbodySite                string
 	MindbodyLocationID          int
 	MindbodyMessageSignatureKey string
+	MindbodyTimeZone            *time.Location // Time zone of the MINDBODY site. MINDBODY dates do not include a time zone
+	MindbodyVerifyArrivals      bool           // Check MINDBODY visit history before logging an arrival
+	MindbodyArrivalTypeID       int            // Optional ArrivalTypeId sent with each arrival
+	MindbodyContractHolds       bool           // Suspend members while their contract is on hold
+	MindbodyHoldRecheck         Duration       // Time between checks of contracts on hold without an end date
+	MindbodyRequireWaiver       bool           // Suspend members until they have signed the liability waiver
+
+	MindbodyBalanceCheck     bool     // Suspend members with overdue account balances
+	MindbodyBalanceThreshold float64  // Maximum amount a member may owe before they are suspended
+	MindbodyAutopayFailures  bool     // Also suspend members with a failed autopay
+	MindbodyBalanceRecheck   Duration // Time between balance checks for overdue members
+
+	HouseholdRelationships []HouseholdRelationship // MINDBODY relationships that link payers and dependents
+
+	ArrivalWindow            Duration            // Default time between logged arrivals for a user
+	ArrivalWindowSites       map[int]Duration    // Overrides keyed by Brivo site ID
+	ArrivalWindowMemberships map[string]Duration // Overrides keyed by MINDBODY membership name
+	ArrivalRetryAttempts     int                 // Maximum attempts for a failed arrival before giving up
+	ArrivalRetryBackoff      Duration            // Delay before the first retry. Doubles on each attempt
+	ArrivalErrorActions      map[string][]string // Follow-up actions keyed by ArrivalError reason
+	ArrivalNotifyURL         string              // Front desk notification URL for the notify action
 
 	RedisURL string
 
@@ -52,32 +107,327 @@ func (config *Config) GetConfig() {
 		}
 	}
 
-	config.BrivoUsername = getEnvStrings("brivo_username", "")
-	config.BrivoPassword = getEnvStrings("brivo_password", "")
-	config.BrivoClientID = getEnvStrings("brivo_client_id", "")
-	config.BrivoClientSecret = getEnvStrings("brivo_client_secret", "")
-	config.BrivoAPIKey = getEnvStrings("brivo_api_key", "")
-	config.BrivoFacilityCode, _ = strconv.Atoi(getEnvStrings("brivo_facility_code", "0"))
-	config.BrivoSiteID, _ = strconv.Atoi(getEnvStrings("brivo_site_id", "0"))
-	config.BrivoMemberGroupID, _ = strconv.Atoi(getEnvStrings("brivo_member_group_id", "0"))
-	config.BrivoBarcodeFieldID, _ = strconv.Atoi(getEnvStrings("brivo_barcode_field_id", "0"))
-	config.BrivoUserTypeFieldID, _ = strconv.Atoi(getEnvStrings("brivo_user_type_field_id", "0"))
-	config.BrivoRateLimit, _ = strconv.Atoi(getEnvStrings("brivo_rate_limit", "20"))
+	config.load(settings{})
+}
+
+// Load each setting into Config. Values in `s` take precedence over environment variables
+func (config *Config) load(s settings) {
+	config.TenantKey = s["key"] // Only set by tenants
+
+	config.BrivoUsername = s.get("brivo_username", "")
+	config.BrivoPassword = s.get("brivo_password", "")
+	config.BrivoClientID = s.get("brivo_client_id", "")
+	config.BrivoClientSecret = s.get("brivo_client_secret", "")
+	config.BrivoAPIKey = s.get("brivo_api_key", "")
+	config.BrivoFacilityCode, _ = strconv.Atoi(s.get("brivo_facility_code", "0"))
+	config.BrivoSiteID, _ = strconv.Atoi(s.get("brivo_site_id", "0"))
+	config.BrivoMemberGroupID, _ = strconv.Atoi(s.get("brivo_member_group_id", "0"))
+	config.BrivoMemberGroupName = s.get("brivo_member_group_name", "Members")
+	config.BrivoBarcodeFieldID, _ = strconv.Atoi(s.get("brivo_barcode_field_id", "0"))
+	config.BrivoBarcodeFieldName = s.get("brivo_barcode_field_name", "Barcode ID")
+	config.BrivoUserTypeFieldID, _ = strconv.Atoi(s.get("brivo_user_type_field_id", "0"))
+	config.BrivoUserTypeFieldName = s.get("brivo_user_type_field_name", "User Type")
+	config.BrivoReasonFieldID, _ = strconv.Atoi(s.get("brivo_reason_field_id", "0"))
+	config.BrivoHouseholdFieldID, _ = strconv.Atoi(s.get("brivo_household_field_id", "0"))
+	config.BrivoRateLimit, _ = strconv.Atoi(s.get("brivo_rate_limit", "20"))
+	config.BrivoStaffGroupID, _ = strconv.Atoi(s.get("brivo_staff_group_id", "0"))
+	config.StaffSyncInterval = s.getDuration("staff_sync_interval", "1h")
+	config.BrivoGuestGroupID, _ = strconv.Atoi(s.get("brivo_guest_group_id", "0"))
+	s.getJSON("guest_products", &config.GuestProducts)
+	config.BrivoClassGroupID, _ = strconv.Atoi(s.get("brivo_class_group_id", "0"))
+	config.ClassAccessBefore = s.getDuration("class_access_before", "15m")
+	config.ClassAccessAfter = s.getDuration("class_access_after", "15m")
+	config.BrivoMinorGroupID, _ = strconv.Atoi(s.get("brivo_minor_group_id", "0"))
+	config.MinorAge, _ = strconv.Atoi(s.get("minor_age", "0"))
+	config.SweeperInterval = s.getDuration("sweeper_interval", "0")
+	config.SweeperRequireMembership, _ = strconv.ParseBool(s.get("sweeper_require_membership", "false"))
+	s.getJSON("brivo_facilities", &config.BrivoFacilities)
+	config.buildFacilities()
+	s.getJSON("brivo_group_rules", &config.BrivoGroupRules)
+	s.getJSON("brivo_field_mappings", &config.BrivoFieldMappings)
+	for _, mapping := range config.BrivoFieldMappings {
+		if err := mapping.validate(); err != nil {
+			log.Fatalf("Error parsing brivo_field_mappings: %s", err)
+		}
+	}
+
+	// Patterns without a `facility` group use the barcode facility code. Defaults to the first facility
+	barcodePattern := s.get("barcode_pattern", "")
+	if barcodePattern == "" {
+		barcodePattern = defaultBarcodePattern
+	}
+	barcodeFacilityCode, err := strconv.Atoi(s.get("barcode_facility_code", ""))
+	if err != nil {
+		barcodeFacilityCode = config.BrivoFacilities[0].Code
+	}
+	parser, err := NewBarcodeParser(barcodePattern, barcodeFacilityCode)
+	if err != nil {
+		log.Fatalf("Error parsing barcode_pattern: %s", err)
+	}
+	config.BarcodeParser = parser
+
+	// Format and field IDs are resolved from Brivo by LoadCredentialFormat
+	formatID, _ := strconv.Atoi(s.get("brivo_credential_format_id", "0"))
+	format := s.get("brivo_credential_format", "")
+	if format == "" {
+		format = FormatStandard26
+	}
+	generator, err := NewCredentialGenerator(format, formatID)
+	if err != nil {
+		log.Fatalf("Error parsing brivo_credential_format: %s", err)
+	}
+	config.CredentialGenerator = generator
+
+	config.CredentialContractDates, _ = strconv.ParseBool(s.get("credential_contract_dates", "false"))
+
+	config.BrivoMobilePass = s.get("brivo_mobile_pass", "")
+	switch config.BrivoMobilePass {
+	case "":
+		config.BrivoMobilePass = MobilePassOff
+	case MobilePassOff, MobilePassAlongside, MobilePassOnly:
+	default:
+		log.Fatalf("Error parsing brivo_mobile_pass: %s is not one of off, alongside or only", config.BrivoMobilePass)
+	}
+
+	config.MindbodyAPIKey = s.get("mindbody_api_key", "")
+	config.MindbodyUsername = s.get("mindbody_username", "")
+	config.MindbodyPassword = s.get("mindbody_password", "")
+	config.MindbodySite = s.get("mindbody_site", "-99")
+	config.MindbodyLocationID, _ = strconv.Atoi(s.get("mindbody_location_id", "1"))
+	config.MindbodyMessageSignatureKey = s.get("mindbody_message_signature_key", "")
+	config.MindbodyTimeZone = time.Local
+	if timeZone := s.get("mindbody_timezone", ""); timeZone != "" {
+		if config.MindbodyTimeZone, err = time.LoadLocation(timeZone); err != nil {
+			log.Fatalf("Error parsing mindbody_timezone: %s", err)
+		}
+	}
+	config.MindbodyVerifyArrivals, _ = strconv.ParseBool(s.get("mindbody_verify_arrivals", "false"))
+	config.MindbodyArrivalTypeID, _ = strconv.Atoi(s.get("mindbody_arrival_type_id", "0"))
+	config.MindbodyContractHolds, _ = strconv.ParseBool(s.get("mindbody_contract_holds", "false"))
+	config.MindbodyHoldRecheck = s.getDuration("mindbody_hold_recheck", "1h")
+	config.MindbodyRequireWaiver, _ = strconv.ParseBool(s.get("mindbody_require_waiver", "false"))
+	config.MindbodyBalanceCheck, _ = strconv.ParseBool(s.get("mindbody_balance_check", "false"))
+	config.MindbodyBalanceThreshold, _ = strconv.ParseFloat(s.get("mindbody_balance_threshold", "0"), 64)
+	config.MindbodyAutopayFailures, _ = strconv.ParseBool(s.get("mindbody_autopay_failures", "false"))
+	config.MindbodyBalanceRecheck = s.getDuration("mindbody_balance_recheck", "15m")
+
+	s.getJSON("household_relationships", &config.HouseholdRelationships)
+
+	// Sites without access_policies use the policies enabled by their own settings
+	var policyNames []string
+	s.getJSON("access_policies", &policyNames)
+	if len(policyNames) == 0 {
+		policyNames = config.defaultPolicies()
+	}
+	config.AccessPolicies = nil
+	for _, name := range policyNames {
+		policy, err := NewPolicy(name)
+		if err != nil {
+			log.Fatalf("Error parsing access_policies: %s", err)
+		}
+		config.AccessPolicies = append(config.AccessPolicies, policy)
+	}
+	// Without status inactive clients have access, and without groups members are
+	// removed from every group
+	for _, name := range []string{PolicyStatus, PolicyGroups} {
+		if config.findPolicy(name) == nil {
+			log.Fatalf("Error parsing access_policies: %s policy is required", name)
+		}
+	}
+
+	config.ArrivalWindow = s.getDuration("arrival_window", "30m")
+	s.getJSON("arrival_window_sites", &config.ArrivalWindowSites)
+	s.getJSON("arrival_window_memberships", &config.ArrivalWindowMemberships)
+	config.validateArrivalWindows()
+	config.ArrivalRetryAttempts, _ = strconv.Atoi(s.get("arrival_retry_attempts", "5"))
+	config.ArrivalRetryBackoff = s.getDuration("arrival_retry_backoff", "1m")
+	s.getJSON("arrival_error_actions", &config.ArrivalErrorActions)
+	config.ArrivalNotifyURL = s.get("arrival_notify_url", "")
+
+	config.RedisURL = s.get("REDIS_URL", "")
+
+	config.Debug, _ = strconv.ParseBool(s.get("DEBUG", "true"))
+	config.Proxy, _ = strconv.ParseBool(s.get("PROXY", "false"))
+	config.Port = s.get("PORT", "")
+	config.Env = s.get("ENV", "development")
+}
+
+// Tenant settings that never fall back to the environment, so that a tenant cannot use
+// another site's credentials
+var tenantCredentials = []string{
+	"brivo_username",
+	"brivo_password",
+	"brivo_client_id",
+	"brivo_client_secret",
+	"brivo_api_key",
+	"mindbody_api_key",
+	"mindbody_username",
+	"mindbody_password",
+	"mindbody_site",
+	"mindbody_message_signature_key",
+}
+
+// GetTenantConfigs builds a Config for each tenant in the `tenants` environment variable.
+// Tenant settings use the same keys as the environment variables and fall back to the
+// environment when not set, except for credentials which each tenant must set. If
+// `tenants` is not set, Config is returned as the only tenant.
+func (config *Config) GetTenantConfigs() ([]*Config, error) {
+	value := getEnvStrings("tenants", "")
+	if value == "" {
+		return []*Config{config}, nil
+	}
+
+	var tenants []map[string]interface{}
+	if err := json.Unmarshal([]byte(value), &tenants); err != nil {
+		return nil, fmt.Errorf("Error parsing tenants: %s", err)
+	}
+
+	var (
+		configs []*Config
+		keys    = make(map[string]bool)
+	)
+	for i, tenant := range tenants {
+		// Convert JSON values to strings so they can be parsed like environment variables
+		s := make(settings)
+		for k, v := range tenant {
+			if str, ok := v.(string); ok {
+				s[k] = str
+				continue
+			}
+			bytes, err := json.Marshal(v)
+			if err != nil {
+				return nil, fmt.Errorf("Error parsing tenant setting %s: %s", k, err)
+			}
+			s[k] = string(bytes)
+		}
+
+		key := s["key"]
+		if key == "" {
+			return nil, fmt.Errorf("Tenant %d is missing a key", i)
+		}
+		if keys[key] {
+			return nil, fmt.Errorf("Tenant key %s is not unique", key)
+		}
+		keys[key] = true
+		for _, name := range tenantCredentials {
+			if s[name] == "" {
+				return nil, fmt.Errorf("Tenant %s is missing %s", key, name)
+			}
+		}
+
+		var c Config
+		c.load(s)
+		configs = append(configs, &c)
+	}
+
+	return configs, nil
+}
 
-	config.MindbodyAPIKey = getEnvStrings("mindbody_api_key", "")
-	config.MindbodyUsername = getEnvStrings("mindbody_username", "")
-	config.MindbodyPassword = getEnvStrings("mindbody_password", "")
-	config.MindbodySite = getEnvStrings("mindbody_site", "-99")
-	config.MindbodyLocationID, _ = strconv.Atoi(getEnvStrings("mindbody_location_id", "1"))
-	config.MindbodyMessageSignatureKey = getEnvStrings("mindbody_message_signature_key", "")
+// GetTenantConfig returns the Config for the tenant with `key`. If there is only one
+// tenant, `key` may be empty.
+func (config *Config) GetTenantConfig(key string) (*Config, error) {
+	configs, err := config.GetTenantConfigs()
+	if err != nil {
+		return nil, err
+	}
+	if key == "" && len(configs) == 1 {
+		return configs[0], nil
+	}
+	for _, c := range configs {
+		if c.TenantKey == key {
+			return c, nil
+		}
+	}
+	return nil, fmt.Errorf("Tenant %s not found", key)
+}
+
+// RedisKey builds a Redis key that is namespaced to the tenant. Eg: downtown:arrival:12345
+func (config *Config) RedisKey(parts ...string) string {
+	if config.TenantKey != "" {
+		parts = append([]string{config.TenantKey}, parts...)
+	}
+	return db.Key(parts...)
+}
 
-	config.RedisURL = getEnvStrings("REDIS_URL", "")
+// Facility maps the facility code prefix of a MINDBODY barcode ID to the Brivo
+// credential facility code and the Brivo groups members should be assigned to
+type Facility struct {
+	Code                   int   `json:"code"`                   // Facility code prefix of the barcode ID
+	CredentialFacilityCode int   `json:"credentialFacilityCode"` // Facility code of the Brivo credential. Defaults to Code
+	GroupIDs               []int `json:"groupIds"`               // Brivo groups for members with this facility code
+}
 
-	config.Debug, _ = strconv.ParseBool(getEnvStrings("DEBUG", "true"))
-	config.Proxy, _ = strconv.ParseBool(getEnvStrings("PROXY", "false"))
-	config.Port = getEnvStrings("PORT", "")
-	config.Env = getEnvStrings("ENV", "development")
+// GetFacility returns the Facility that matches the barcode ID. Returns false if the
+// barcode ID is not valid or does not match any of the configured facilities
+func (config *Config) GetFacility(barcodeID string) (Facility, bool) {
+	barcode, err := config.ParseBarcode(barcodeID)
+	if err != nil {
+		return Facility{}, false
+	}
+	return barcode.Facility, true
+}
+
+// MemberGroupIDs returns the unique Brivo group IDs across all facilities and the minor group
+func (config *Config) MemberGroupIDs() []int {
+	var (
+		groupIDs []int
+		seen     = make(map[int]bool)
+	)
+	if config.BrivoMinorGroupID != 0 {
+		seen[config.BrivoMinorGroupID] = true
+		groupIDs = append(groupIDs, config.BrivoMinorGroupID)
+	}
+	for _, facility := range config.BrivoFacilities {
+		for _, groupID := range facility.GroupIDs {
+			if !seen[groupID] {
+				seen[groupID] = true
+				groupIDs = append(groupIDs, groupID)
+			}
+		}
+	}
+	return groupIDs
+}
+
+// Returns the time zone of the MINDBODY site
+func (config *Config) timeZone() *time.Location {
+	if config.MindbodyTimeZone == nil {
+		return time.Local
+	}
+	return config.MindbodyTimeZone
+}
+
+// Arrival windows are stored as Redis key expiry times in whole seconds
+func (config *Config) validateArrivalWindows() {
+	if config.ArrivalWindow.Duration < time.Second {
+		log.Fatalf("Error parsing arrival_window: %s is less than 1s", config.ArrivalWindow)
+	}
+	for siteID, window := range config.ArrivalWindowSites {
+		if window.Duration < time.Second {
+			log.Fatalf("Error parsing arrival_window_sites: %s for site %d is less than 1s", window, siteID)
+		}
+	}
+	for membership, window := range config.ArrivalWindowMemberships {
+		if window.Duration < time.Second {
+			log.Fatalf("Error parsing arrival_window_memberships: %s for %s is less than 1s", window, membership)
+		}
+	}
+}
 
+// Use brivo_facility_code and brivo_member_group_id if brivo_facilities is not set
+func (config *Config) buildFacilities() {
+	if len(config.BrivoFacilities) == 0 {
+		config.BrivoFacilities = []Facility{{
+			Code:                   config.BrivoFacilityCode,
+			CredentialFacilityCode: config.BrivoFacilityCode,
+			GroupIDs:               []int{config.BrivoMemberGroupID},
+		}}
+		return
+	}
+	for i := range config.BrivoFacilities {
+		if config.BrivoFacilities[i].CredentialFacilityCode == 0 {
+			config.BrivoFacilities[i].CredentialFacilityCode = config.BrivoFacilities[i].Code
+		}
+	}
 }
 
 // Base64Encoded credentials for Authorization header
@@ -92,3 +442,53 @@ func getEnvStrings(key string, defaultValue string) string {
 	}
 	return defaultValue
 }
+
+// Settings keyed by environment variable name. Used to override environment variables for each tenant
+type settings map[string]string
+
+// Look up a setting, falling back to the environment variable
+func (s settings) get(key string, defaultValue string) string {
+	if value, exists := s[key]; exists {
+		return value
+	}
+	return getEnvStrings(key, defaultValue)
+}
+
+// Parse duration strings such as "30m" or "24h"
+func (s settings) getDuration(key string, defaultValue string) Duration {
+	d, err := time.ParseDuration(s.get(key, defaultValue))
+	if err != nil {
+		log.Fatalf("Error parsing %s: %s", key, err)
+	}
+	return Duration{d}
+}
+
+// Unmarshal JSON settings into `output`
+func (s settings) getJSON(key string, output interface{}) {
+	value := s.get(key, "")
+	if value == "" {
+		return
+	}
+	if err := json.Unmarshal([]byte(value), output); err != nil {
+		log.Fatalf("Error parsing %s: %s", key, err)
+	}
+}
+
+// Duration wraps time.Duration so that it can be unmarshalled from JSON strings
+type Duration struct {
+	time.Duration
+}
+
+// UnmarshalJSON parses a duration string such as "4h" into Duration
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	value, err := time.ParseDuration(s)
+	if err != nil {
+		return fmt.Errorf("Invalid duration %s: %s", s, err)
+	}
+	d.Duration = value
+	return nil
+}
@@ -7,12 +7,12 @@ package models
 
 import (
 	"bytes"
-	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 
 	utils "github.com/christophertino/mindbody-brivo"
 )
@@ -32,6 +32,8 @@ type Credential struct {
 	ReferenceID       string           `json:"referenceId"` // Barcode ID (MindBodyUser.ID | BrivoUser.CustomField BarcodeID)
 	EncodedCredential string           `json:"encodedCredential,omitempty"`
 	FieldValues       []FieldValue     `json:"fieldValues,omitempty"`
+	EffectiveFrom     *time.Time       `json:"effectiveFrom,omitempty"`
+	EffectiveTo       *time.Time       `json:"effectiveTo,omitempty"` // Set from MINDBODY contract end dates
 }
 
 // CredentialFormat stores the Brivo credential format
@@ -86,48 +88,25 @@ func (cred *Credential) CreateCredential(brivoAPIKey string, brivoAccessToken st
 	}
 }
 
-// GenerateStandardCredential creates a Standard 26 Bit credential that uses the MINDBODY
-// barcode ID and Brivo facility code as Field Values
-func GenerateStandardCredential(barcodeID string, facilityCode int) *Credential {
-	cred := Credential{
-		CredentialFormat: CredentialFormat{
-			ID: 100, // Standard 26 Bit Format
-		},
-		ReferenceID: barcodeID,
-		FieldValues: []FieldValue{
-			FieldValue{
-				ID:    1,                                                                   // card_number
-				Value: strings.Replace(barcodeID, fmt.Sprintf("%d-", facilityCode), "", 1), // remove facilityCode from barcodeID
-			},
-			FieldValue{
-				ID:    2, // facility_code
-				Value: strconv.Itoa(facilityCode),
-			},
-		},
-	}
-	return &cred
-}
-
-// GenerateUnknownCredential creates an encoded credential using format 110 Unknown
-// @deprecated
-func GenerateUnknownCredential(barcodeID string) *Credential {
-	cred := Credential{
-		CredentialFormat: CredentialFormat{
-			ID: 110, // Unknown Format
-		},
-		ReferenceID:       barcodeID, // barcode ID
-		EncodedCredential: hex.EncodeToString([]byte(barcodeID)),
-	}
-	return &cred
-}
-
 // Get a Brivo credential by reference_id (Credential.ReferenceID) and return the
 // Credential. The ReferenceID should contain the MINDBODY barcodeID
 func getCredentialByRefID(barcodeID string, brivoAPIKey string, brivoAccessToken string) (Credential, error) {
+	cred, found, err := findCredentialByRefID(barcodeID, brivoAPIKey, brivoAccessToken)
+	if err != nil {
+		return Credential{}, err
+	}
+	if !found {
+		return Credential{}, fmt.Errorf("Credential with ReferenceID %s not found", barcodeID)
+	}
+	return cred, nil
+}
+
+// Find a Brivo credential by reference_id. Returns false if the credential does not exist
+func findCredentialByRefID(refID string, brivoAPIKey string, brivoAccessToken string) (Credential, bool, error) {
 	// Create HTTP request
-	req, err := http.NewRequest("GET", fmt.Sprintf("https://api.brivo.com/v1/api/credentials?filter=reference_id__eq:%s", barcodeID), nil)
+	req, err := http.NewRequest("GET", fmt.Sprintf("https://api.brivo.com/v1/api/credentials?filter=reference_id__eq:%s", refID), nil)
 	if err != nil {
-		return Credential{}, fmt.Errorf("Error creating HTTP request: %s", err)
+		return Credential{}, false, fmt.Errorf("Error creating HTTP request: %s", err)
 	}
 	req.Header.Add("Content-Type", "application/json")
 	req.Header.Add("Authorization", "Bearer "+brivoAccessToken)
@@ -135,16 +114,16 @@ func getCredentialByRefID(barcodeID string, brivoAPIKey string, brivoAccessToken
 
 	var creds CredentialList
 	if err = utils.DoRequest(req, &creds); err != nil {
-		return Credential{}, err
+		return Credential{}, false, err
 	}
 
 	// The count should always be 1 or 0
 	if creds.Count > 0 {
-		utils.Logger(fmt.Sprintf("Successfully fetched Credential ID %d for Reference ID %s", creds.Data[0].ID, barcodeID))
-		return creds.Data[0], nil
+		utils.Logger(fmt.Sprintf("Successfully fetched Credential ID %d for Reference ID %s", creds.Data[0].ID, refID))
+		return creds.Data[0], true, nil
 	}
 
-	return Credential{}, fmt.Errorf("Credential with ReferenceID %s not found", barcodeID)
+	return Credential{}, false, nil
 }
 
 // GetCredentialByID returns a user credential based on the Brivo credential ID
@@ -225,3 +204,93 @@ func (cred *Credential) DeleteCredential(brivoAPIKey string, brivoAccessToken st
 
 	return nil
 }
+
+// Types of credentials a user may hold. The type is derived from the credential ReferenceID
+const (
+	CredentialWristband = "wristband" // ReferenceID is the MINDBODY barcode ID
+	CredentialMobile    = "mobile"    // ReferenceID is `mobile-<ExternalID>`
+	CredentialFob       = "fob"       // ReferenceID is `fob-<fob number>`. Key fobs are assigned manually in Brivo
+	CredentialUnmanaged = "unmanaged" // Not created or tracked by the application
+)
+
+const fobPrefix = "fob-"
+
+// CredentialType returns the type of the credential based on its ReferenceID
+func (config *Config) CredentialType(cred Credential) string {
+	switch {
+	case strings.HasPrefix(cred.ReferenceID, mobilePassPrefix):
+		return CredentialMobile
+	case strings.HasPrefix(cred.ReferenceID, fobPrefix):
+		return CredentialFob
+	}
+	if _, ok := config.GetFacility(cred.ReferenceID); ok {
+		return CredentialWristband
+	}
+	return CredentialUnmanaged
+}
+
+// GetCredentialsForUser fetches all credentials assigned to the user
+func (creds *CredentialList) GetCredentialsForUser(userID int, brivoAPIKey string, brivoAccessToken string) error {
+	// Create HTTP request
+	req, err := http.NewRequest("GET", fmt.Sprintf("https://api.brivo.com/v1/api/users/%d/credentials?pageSize=100", userID), nil)
+	if err != nil {
+		return fmt.Errorf("Error creating HTTP request: %s", err)
+	}
+	req.Header.Add("Content-Type", "application/json")
+	req.Header.Add("Authorization", "Bearer "+brivoAccessToken)
+	req.Header.Add("api-key", brivoAPIKey)
+
+	if err = utils.DoRequest(req, creds); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Delete all of the user's credentials of `credType` and the credential with `referenceID`.
+// The old barcode may no longer match the barcode pattern or facilities, so it is also
+// found by reference ID. Other credentials are left alone
+func (user *BrivoUser) removeCredentials(credType string, referenceID string, config Config, auth *Auth) error {
+	var creds CredentialList
+	if err := creds.GetCredentialsForUser(user.ID, config.BrivoAPIKey, auth.BrivoToken.AccessToken); err != nil {
+		return fmt.Errorf("Error fetching credentials for user %s: %s", user.ExternalID, err)
+	}
+	for _, cred := range creds.Data {
+		if config.CredentialType(cred) != credType && (referenceID == "" || cred.ReferenceID != referenceID) {
+			continue
+		}
+		if err := cred.DeleteCredential(config.BrivoAPIKey, auth.BrivoToken.AccessToken); err != nil {
+			fmt.Printf("Error deleting Credential ID %s with message: %s\n", cred.ReferenceID, err)
+			continue
+		}
+		fmt.Printf("Deleted %s credential %s for user %s\n", credType, cred.ReferenceID, user.ExternalID)
+	}
+	return nil
+}
+
+// UnmanagedCredentials returns the credentials assigned to the MINDBODY user's Brivo
+// account that are not managed by the application. This includes wristbands that
+// do not match the user's current barcode ID.
+func UnmanagedCredentials(mbUser MindBodyUser, config Config, auth *Auth) ([]Credential, error) {
+	var brivoUser BrivoUser
+	if err := brivoUser.getUserByExternalID(strconv.Itoa(mbUser.UniqueID), config.BrivoAPIKey, auth.BrivoToken.AccessToken); err != nil {
+		return nil, err
+	}
+	var creds CredentialList
+	if err := creds.GetCredentialsForUser(brivoUser.ID, config.BrivoAPIKey, auth.BrivoToken.AccessToken); err != nil {
+		return nil, err
+	}
+
+	var unmanaged []Credential
+	for _, cred := range creds.Data {
+		switch config.CredentialType(cred) {
+		case CredentialUnmanaged:
+			unmanaged = append(unmanaged, cred)
+		case CredentialWristband:
+			if cred.ReferenceID != mbUser.ID {
+				unmanaged = append(unmanaged, cred)
+			}
+		}
+	}
+	return unmanaged, nil
+}
@@ -0,0 +1,266 @@
+// Brivo Credential Formats
+//
+// Credentials are generated from the MINDBODY barcode ID using the format set by
+// `brivo_credential_format`. Format and field IDs are looked up from the Brivo
+// credential formats listing when the application starts.
+// See https://apidocs.brivo.com/#api-Credential-ListCredentialFormats
+
+package models
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	utils "github.com/christophertino/mindbody-brivo"
+)
+
+// Supported values for `brivo_credential_format`
+const (
+	FormatStandard26    = "standard26"    // Standard 26 Bit (H10301)
+	FormatH10304        = "h10304"        // 37 Bit H10304
+	FormatCorporate1000 = "corporate1000" // 35 Bit HID Corporate 1000
+	FormatEncoded       = "encoded"       // Raw hex encoded barcode ID
+)
+
+// CredentialFormats is the data format returned when listing credential formats from Brivo
+type CredentialFormats struct {
+	Data  []CredentialFormatDefinition `json:"data"`
+	Count int                          `json:"count"`
+}
+
+// CredentialFormatDefinition stores a Brivo credential format and its fields
+type CredentialFormatDefinition struct {
+	ID      int                     `json:"id"`
+	Name    string                  `json:"name"`
+	NumBits int                     `json:"numBits"`
+	Fields  []CredentialFormatField `json:"fieldDefinitions"`
+}
+
+// CredentialFormatField stores a single field of a Brivo credential format
+type CredentialFormatField struct {
+	ID   int    `json:"id"`
+	Name string `json:"name"`
+}
+
+// CredentialGenerator creates Brivo credentials from MINDBODY barcodes
+type CredentialGenerator interface {
+	// Resolve looks up the format and field IDs from the Brivo credential formats
+	Resolve(formats CredentialFormats) error
+	// Generate creates a credential for the barcode
+	Generate(barcode Barcode) (*Credential, error)
+}
+
+// NewCredentialGenerator returns the CredentialGenerator for `name`. If `formatID` is
+// set, it is used instead of looking up the format by name.
+func NewCredentialGenerator(name string, formatID int) (CredentialGenerator, error) {
+	switch name {
+	case FormatStandard26:
+		return &fieldFormat{
+			name:           name,
+			formatID:       formatID,
+			keyword:        "standard",
+			numBits:        26,
+			facilityFields: []string{"facility_code"},
+			maxFacility:    1<<8 - 1,
+			maxCard:        1<<16 - 1,
+		}, nil
+	case FormatH10304:
+		return &fieldFormat{
+			name:           name,
+			formatID:       formatID,
+			keyword:        "h10304",
+			numBits:        37,
+			facilityFields: []string{"facility_code"},
+			maxFacility:    1<<16 - 1,
+			maxCard:        1<<19 - 1,
+		}, nil
+	case FormatCorporate1000:
+		return &fieldFormat{
+			name:           name,
+			formatID:       formatID,
+			keyword:        "corporate",
+			numBits:        35,
+			facilityFields: []string{"company_code", "company_id", "facility_code"},
+			maxFacility:    1<<12 - 1,
+			maxCard:        1<<20 - 1,
+		}, nil
+	case FormatEncoded:
+		return &encodedFormat{
+			formatID: formatID,
+		}, nil
+	}
+	return nil, fmt.Errorf("Credential format %s not found", name)
+}
+
+// ListCredentialFormats fetches the credential formats supported by the Brivo account
+func (formats *CredentialFormats) ListCredentialFormats(brivoAPIKey string, brivoAccessToken string) error {
+	// Create HTTP request
+	req, err := http.NewRequest("GET", "https://api.brivo.com/v1/api/credentials/formats?pageSize=100", nil)
+	if err != nil {
+		return fmt.Errorf("Error creating HTTP request: %s", err)
+	}
+	req.Header.Add("Content-Type", "application/json")
+	req.Header.Add("Authorization", "Bearer "+brivoAccessToken)
+	req.Header.Add("api-key", brivoAPIKey)
+
+	if err = utils.DoRequest(req, formats); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// LoadCredentialFormat resolves the configured credential format against the formats
+// available in Brivo. Must be called before any credentials are generated.
+func (config *Config) LoadCredentialFormat(brivoAPIKey string, brivoAccessToken string) error {
+	var formats CredentialFormats
+	if err := formats.ListCredentialFormats(brivoAPIKey, brivoAccessToken); err != nil {
+		return fmt.Errorf("Error fetching Brivo credential formats: %s", err)
+	}
+	return config.CredentialGenerator.Resolve(formats)
+}
+
+// Find the format with `formatID`, or the format with `numBits` whose name contains `keyword`
+func (formats CredentialFormats) find(formatID int, keyword string, numBits int) (CredentialFormatDefinition, error) {
+	var matches []CredentialFormatDefinition
+	for _, format := range formats.Data {
+		if formatID != 0 {
+			if format.ID == formatID {
+				return format, nil
+			}
+			continue
+		}
+		if strings.Contains(strings.ToLower(format.Name), keyword) && (numBits == 0 || format.NumBits == numBits) {
+			matches = append(matches, format)
+		}
+	}
+	if formatID != 0 {
+		return CredentialFormatDefinition{}, fmt.Errorf("Credential format ID %d not found in Brivo", formatID)
+	}
+	switch len(matches) {
+	case 0:
+		return CredentialFormatDefinition{}, fmt.Errorf("Credential format matching %q not found in Brivo", keyword)
+	case 1:
+		return matches[0], nil
+	}
+	return CredentialFormatDefinition{}, fmt.Errorf("More than one credential format matches %q. Set brivo_credential_format_id", keyword)
+}
+
+// Return the ID of the first field in `names`
+func (format CredentialFormatDefinition) fieldID(names ...string) (int, error) {
+	for _, name := range names {
+		for _, field := range format.Fields {
+			if strings.EqualFold(field.Name, name) {
+				return field.ID, nil
+			}
+		}
+	}
+	return 0, fmt.Errorf("Credential format %s does not have a %s field", format.Name, names[0])
+}
+
+// Formats with card number and facility code fields
+type fieldFormat struct {
+	name           string
+	formatID       int
+	keyword        string   // Matched against the Brivo format name
+	numBits        int      // Matched against the Brivo format bit length
+	facilityFields []string // Possible names of the facility code field
+	maxFacility    int
+	maxCard        int
+
+	cardFieldID     int
+	facilityFieldID int
+	resolved        bool
+}
+
+// Resolve looks up the format and field IDs from the Brivo credential formats
+func (f *fieldFormat) Resolve(formats CredentialFormats) error {
+	format, err := formats.find(f.formatID, f.keyword, f.numBits)
+	if err != nil {
+		return err
+	}
+	if f.cardFieldID, err = format.fieldID("card_number"); err != nil {
+		return err
+	}
+	if f.facilityFieldID, err = format.fieldID(f.facilityFields...); err != nil {
+		return err
+	}
+	f.formatID = format.ID
+	f.resolved = true
+
+	utils.Logger(fmt.Sprintf("Using Brivo credential format %d (%s)", format.ID, format.Name))
+	return nil
+}
+
+// Generate creates a credential that uses the barcode card number and the
+// Facility's credential facility code as Field Values
+func (f *fieldFormat) Generate(barcode Barcode) (*Credential, error) {
+	if !f.resolved {
+		return nil, fmt.Errorf("Credential format %s has not been loaded", f.name)
+	}
+
+	cardNumber, err := strconv.Atoi(barcode.CardNumber)
+	if err != nil || cardNumber < 0 || cardNumber > f.maxCard {
+		return nil, fmt.Errorf("Card number %s is out of range for format %s (0-%d)", barcode.CardNumber, f.name, f.maxCard)
+	}
+	facilityCode := barcode.Facility.CredentialFacilityCode
+	if facilityCode < 0 || facilityCode > f.maxFacility {
+		return nil, fmt.Errorf("Facility code %d is out of range for format %s (0-%d)", facilityCode, f.name, f.maxFacility)
+	}
+
+	cred := Credential{
+		CredentialFormat: CredentialFormat{
+			ID: f.formatID,
+		},
+		ReferenceID: barcode.ID,
+		FieldValues: []FieldValue{
+			FieldValue{
+				ID:    f.cardFieldID,
+				Value: barcode.CardNumber,
+			},
+			FieldValue{
+				ID:    f.facilityFieldID,
+				Value: strconv.Itoa(facilityCode),
+			},
+		},
+	}
+	return &cred, nil
+}
+
+// Formats that use the hex encoded barcode ID instead of field values
+type encodedFormat struct {
+	formatID int
+	resolved bool
+}
+
+// Resolve looks up the format ID from the Brivo credential formats. Defaults to the Unknown format
+func (f *encodedFormat) Resolve(formats CredentialFormats) error {
+	format, err := formats.find(f.formatID, "unknown", 0)
+	if err != nil {
+		return err
+	}
+	f.formatID = format.ID
+	f.resolved = true
+
+	utils.Logger(fmt.Sprintf("Using Brivo credential format %d (%s)", format.ID, format.Name))
+	return nil
+}
+
+// Generate creates an encoded credential from the barcode ID
+func (f *encodedFormat) Generate(barcode Barcode) (*Credential, error) {
+	if !f.resolved {
+		return nil, fmt.Errorf("Credential format %s has not been loaded", FormatEncoded)
+	}
+
+	cred := Credential{
+		CredentialFormat: CredentialFormat{
+			ID: f.formatID,
+		},
+		ReferenceID:       barcode.ID,
+		EncodedCredential: hex.EncodeToString([]byte(barcode.ID)),
+	}
+	return &cred, nil
+}
@@ -39,6 +39,24 @@ func (customFields *CustomFields) GetCustomFieldsForUser(userID int, brivoAPIKey
 	return nil
 }
 
+// ListCustomFields fetches the custom fields defined in the Brivo account
+func (fields *CustomFieldDefinitions) ListCustomFields(brivoAPIKey string, brivoAccessToken string) error {
+	// Create HTTP request
+	req, err := http.NewRequest("GET", "https://api.brivo.com/v1/api/custom-fields?pageSize=100", nil)
+	if err != nil {
+		return fmt.Errorf("Error creating HTTP request: %s", err)
+	}
+	req.Header.Add("Content-Type", "application/json")
+	req.Header.Add("Authorization", "Bearer "+brivoAccessToken)
+	req.Header.Add("api-key", brivoAPIKey)
+
+	if err = utils.DoRequest(req, fields); err != nil {
+		return err
+	}
+
+	return nil
+}
+
 // GenerateCustomField will create a CustomField{} based on an ID and Value
 func GenerateCustomField(customFieldID int, customFieldValue string) *CustomField {
 	customField := CustomField{
@@ -57,3 +75,27 @@ func GetFieldValue(fieldID int, customFields []CustomField) (string, error) {
 	}
 	return "", fmt.Errorf("Custom field %d not found", fieldID)
 }
+
+// Set the value of the custom field with `fieldID` if it is in `customFields`
+func setFieldValue(customFields []CustomField, fieldID int, value string) {
+	for i := range customFields {
+		if customFields[i].ID == fieldID {
+			customFields[i].Value = value
+		}
+	}
+}
+
+// Returns the fields in `customFields` with the same IDs as `fields`, in the order of `fields`.
+// Fields that are not in `customFields` are left out
+func matchingFields(customFields []CustomField, fields []CustomField) []CustomField {
+	var matches []CustomField
+	for _, field := range fields {
+		for _, customField := range customFields {
+			if customField.ID == field.ID {
+				matches = append(matches, customField)
+				break
+			}
+		}
+	}
+	return matches
+}
@@ -0,0 +1,26 @@
+package models
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMatchingFields(t *testing.T) {
+	existing := []CustomField{{ID: 3, Value: "Lapsed"}, {ID: 2, Value: "Member"}, {ID: 1, Value: "100123"}}
+
+	tests := []struct {
+		name   string
+		fields []CustomField
+		want   []CustomField
+	}{
+		{"no fields", nil, nil},
+		{"in order of fields", []CustomField{{ID: 1, Value: "100124"}, {ID: 2, Value: "Member"}}, []CustomField{{ID: 1, Value: "100123"}, {ID: 2, Value: "Member"}}},
+		{"missing field", []CustomField{{ID: 1}, {ID: 4}}, []CustomField{{ID: 1, Value: "100123"}}},
+	}
+
+	for _, test := range tests {
+		if got := matchingFields(existing, test.fields); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: expected %v, got %v", test.name, test.want, got)
+		}
+	}
+}
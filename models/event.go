@@ -3,12 +3,15 @@
 package models
 
 import (
+	"encoding/json"
 	"fmt"
 	"net/http"
-	"sync"
+	"strconv"
 	"time"
 
+	db "github.com/christophertino/mindbody-brivo"
 	utils "github.com/christophertino/mindbody-brivo"
+	"github.com/gomodule/redigo/redis"
 	"github.com/google/go-cmp/cmp"
 )
 
@@ -19,6 +22,7 @@ type Event struct {
 	EventSchemaVersion               float64       `json:"eventSchemaVersion"`
 	EventInstanceOriginationDateTime time.Time     `json:"eventInstanceOriginationDateTime"`
 	EventData                        EventUserData `json:"eventData"`
+	RawEventData                     []byte        `json:"-"` // Unparsed event data for events that are not client events
 }
 
 // EventUserData stores MINDBODY user data sent by webhook events
@@ -34,19 +38,67 @@ type EventUserData struct {
 	MobilePhone      string    `json:"mobilePhone"`
 	HomePhone        string    `json:"homePhone"`
 	WorkPhone        string    `json:"workPhone"`
+	BirthDateTime    string    `json:"birthDateTime"`
 	Status           string    `json:"status"` // Declined,Non-Member,Active,Expired,Suspended,Terminated
 }
 
-var mu sync.Mutex
+// UnmarshalJSON parses the webhook event and keeps the raw event data so that events
+// with other data formats, such as sales, can be parsed by their handlers
+func (event *Event) UnmarshalJSON(b []byte) error {
+	type alias Event
+	var e struct {
+		alias
+		EventData json.RawMessage `json:"eventData"`
+	}
+	if err := json.Unmarshal(b, &e); err != nil {
+		return err
+	}
+	*event = Event(e.alias)
+	event.RawEventData = e.EventData
+	if len(e.EventData) == 0 {
+		return nil
+	}
+	return json.Unmarshal(e.EventData, &event.EventData)
+}
 
 // ProcessEvent handles cases for each webhook EventID
-func (event *Event) ProcessEvent(errChan chan *Event, isRefreshing bool, config *Config, auth *Auth) {
+func (event *Event) ProcessEvent(tenant *Tenant) {
+	config := tenant.Config
+	auth := &tenant.Auth
+
+	// Sale and booking events do not include client data
+	var handler func(*Tenant) error
+	switch event.EventID {
+	case "clientSale.created":
+		handler = event.ProcessSale
+	case "classRosterBooking.created", "appointmentBooking.created":
+		handler = event.ProcessBooking
+	case "classRosterBooking.cancelled", "appointmentBooking.cancelled":
+		handler = event.CancelBooking
+	}
+	if handler != nil {
+		tenant.RateLimit.Wait()
+		if err := handler(tenant); err != nil {
+			// If we get a 401:Unauthorized, the token is expired
+			if err.Error() == "401" {
+				tenant.ErrChan <- event
+				doRefresh(tenant)
+				return
+			}
+			fmt.Printf("Error processing MINDBODY event %s\n%s\n", event.EventID, err)
+		}
+		return
+	}
+
 	// Validate that the ClientID has the correct facility access
-	if !IsValidID(config.BrivoFacilityCode, event.EventData.ClientID) {
+	if _, ok := config.GetFacility(event.EventData.ClientID); !ok {
 		utils.Logger(fmt.Sprintf("User %s does not have a valid ID", event.EventData.ClientID))
 		return
 	}
 
+	// Wait for the tenant's Brivo rate limit
+	tenant.RateLimit.Wait()
+
 	// Route event to correct action
 	switch event.EventID {
 	case "client.created":
@@ -54,26 +106,26 @@ func (event *Event) ProcessEvent(errChan chan *Event, isRefreshing bool, config
 		fallthrough
 	case "client.updated":
 		// Update an existing user
-		if err := event.CreateOrUpdateUser(*config, *auth); err != nil {
+		if err := event.CreateOrUpdateUser(*config, auth, tenant.Pool); err != nil {
 			// If we get a 401:Unauthorized, the token is expired
 			if err.Error() == "401" {
 				// Stash the current event in the error channel
-				errChan <- event
+				tenant.ErrChan <- event
 				// Handle token refresh
-				doRefresh(errChan, isRefreshing, config, auth)
+				doRefresh(tenant)
 				break
 			}
 			fmt.Printf("Error creating/updating Brivo client with MINDBODY ID %d\n%s\n", event.EventData.ClientUniqueID, err)
 		}
 	case "client.deactivated":
 		// Suspend an existing user
-		if err := event.DeactivateUser(*config, *auth); err != nil {
+		if err := event.DeactivateUser(*config, auth, tenant.Pool); err != nil {
 			// If we get a 401:Unauthorized, the token is expired
 			if err.Error() == "401" {
 				// Stash the current event in the error channel
-				errChan <- event
+				tenant.ErrChan <- event
 				// Handle token refresh
-				doRefresh(errChan, isRefreshing, config, auth)
+				doRefresh(tenant)
 				break
 			}
 			fmt.Printf("Error deactivating Brivo client with MINDBODY ID %d\n%s\n", event.EventData.ClientUniqueID, err)
@@ -84,21 +136,38 @@ func (event *Event) ProcessEvent(errChan chan *Event, isRefreshing bool, config
 }
 
 // CreateOrUpdateUser is a webhook event handler for client.updated and client.created
-func (event *Event) CreateOrUpdateUser(config Config, auth Auth) error {
+func (event *Event) CreateOrUpdateUser(config Config, auth *Auth, pool *redis.Pool) error {
+	// Build event data into MINDBODY user
+	var mbUser MindBodyUser
+	mbUser.buildUser(event.EventData)
+
+	return SyncUser(mbUser, config, auth, pool)
+}
+
+// SyncUser creates a new Brivo user for the MINDBODY user or updates the existing
+// Brivo user. This is used by webhook events and reconciliation. Access is decided by
+// the site's policies. `pool` is used to schedule policy rechecks and may be nil.
+func SyncUser(mbUser MindBodyUser, config Config, auth *Auth, pool *redis.Pool) error {
 	var (
 		brivoUser    BrivoUser
-		mbUser       MindBodyUser
 		customFields CustomFields
 	)
+	// MINDBODY details, memberships and contracts are shared by the policies and credential dates
+	client := NewClientContext(mbUser, &config, auth)
+	client.pool = pool
+
 	// Query the user on Brivo using the MINDBODY ClientUniqueID
 	var existingUser BrivoUser
-	err := existingUser.getUserByExternalID(event.EventData.ClientUniqueID, config.BrivoAPIKey, auth.BrivoToken.AccessToken)
+	err := existingUser.getUserByExternalID(strconv.Itoa(mbUser.UniqueID), config.BrivoAPIKey, auth.BrivoToken.AccessToken)
 	switch e := err.(type) {
 	// User already exists: Update user
 	case nil:
-		// Build event data into Brivo user
-		mbUser.buildUser(event.EventData)
+		// Build MINDBODY user into Brivo user
 		brivoUser.BuildUser(mbUser, config)
+		decision, err := brivoUser.applyPolicies(client)
+		if err != nil {
+			return err
+		}
 
 		// Update Brivo ID from existing user
 		brivoUser.ID = existingUser.ID
@@ -109,8 +178,32 @@ func (event *Event) CreateOrUpdateUser(config Config, auth Auth) error {
 		}
 		existingUser.CustomFields = customFields.Data
 
-		// Check diff to see if update is needed
-		if !cmp.Equal(existingUser, brivoUser) {
+		// Guests are not members, so they keep access through the guest group until it expires.
+		// Their member groups are left alone and no deny reason is shown. Once the guest access
+		// has expired, or the policies allow access, the user is a member again
+		if userType, _ := GetFieldValue(config.BrivoUserTypeFieldID, existingUser.CustomFields); userType == UserTypeGuest {
+			guest, err := hasGuestAccess(existingUser.ID, &config, pool)
+			if err != nil {
+				return err
+			}
+			if guest && brivoUser.Suspended {
+				brivoUser.Suspended = existingUser.Suspended
+				decision.Reason = ""
+				setFieldValue(brivoUser.CustomFields, config.BrivoUserTypeFieldID, UserTypeGuest)
+			} else {
+				if err := brivoUser.UpdateCustomField(config.BrivoUserTypeFieldID, UserTypeMember, config.BrivoAPIKey, auth.BrivoToken.AccessToken); err != nil {
+					return fmt.Errorf("Error updating custom field for user %s with error: %s", brivoUser.ExternalID, err)
+				}
+				setFieldValue(existingUser.CustomFields, config.BrivoUserTypeFieldID, UserTypeMember)
+				fmt.Printf("Brivo user %s is no longer a guest\n", brivoUser.ExternalID)
+			}
+		}
+
+		// Check diff to see if update is needed. Only the custom fields set by BuildUser are
+		// compared, as the reason, household and mapped fields are stored separately below
+		compared := existingUser
+		compared.CustomFields = matchingFields(existingUser.CustomFields, brivoUser.CustomFields)
+		if !cmp.Equal(compared, brivoUser) {
 			if err := brivoUser.updateUser(config.BrivoAPIKey, auth.BrivoToken.AccessToken); err != nil {
 				return fmt.Errorf("Error updating user %s: %s", brivoUser.ExternalID, err)
 			}
@@ -121,21 +214,32 @@ func (event *Event) CreateOrUpdateUser(config Config, auth Auth) error {
 					return fmt.Errorf("Error changing suspended status for user %s: %s", brivoUser.ExternalID, err)
 				}
 				fmt.Printf("Brivo user %s suspended status set to %t\n", brivoUser.ExternalID, brivoUser.Suspended)
+
+				// Revoke the mobile pass while suspended and issue a new one on re-activation
+				if config.IssuesMobilePass() {
+					if brivoUser.Suspended {
+						err = brivoUser.RevokeMobilePass(config.BrivoAPIKey, auth.BrivoToken.AccessToken)
+					} else {
+						err = brivoUser.IssueMobilePass(config.BrivoAPIKey, auth.BrivoToken.AccessToken)
+					}
+					if err != nil {
+						return fmt.Errorf("Error updating mobile pass for user %s: %s", brivoUser.ExternalID, err)
+					}
+				}
+			} else if config.IssuesMobilePass() && !brivoUser.Suspended && existingUser.primaryEmail() != brivoUser.primaryEmail() {
+				// The mobile pass invitation is sent to the user's email so it needs to be reissued
+				if err := brivoUser.reissueMobilePass(config.BrivoAPIKey, auth.BrivoToken.AccessToken); err != nil {
+					return fmt.Errorf("Error reissuing mobile pass for user %s: %s", brivoUser.ExternalID, err)
+				}
 			}
 
 			// Check if the barcode ID has changed
 			existingBarcode, _ := GetFieldValue(config.BrivoBarcodeFieldID, existingUser.CustomFields)
 			newBarcode, _ := GetFieldValue(config.BrivoBarcodeFieldID, brivoUser.CustomFields)
 			if existingBarcode != newBarcode {
-				// Check to see if the credential exists for this user
-				oldCred, err := getCredentialByRefID(existingBarcode, config.BrivoAPIKey, auth.BrivoToken.AccessToken)
-				if err == nil {
-					// Delete the old credential
-					if err := oldCred.DeleteCredential(config.BrivoAPIKey, auth.BrivoToken.AccessToken); err != nil {
-						fmt.Printf("Error deleting Credential ID %s with message: %s\n", existingBarcode, err)
-					}
-				} else {
-					fmt.Printf("Credential ID %s not found: %s\n", existingBarcode, err)
+				// Replace the wristband credential. Mobile passes and key fobs are kept
+				if err := brivoUser.removeCredentials(CredentialWristband, existingBarcode, config, auth); err != nil {
+					return err
 				}
 
 				// Update barcode ID in custom fields
@@ -144,21 +248,58 @@ func (event *Event) CreateOrUpdateUser(config Config, auth Auth) error {
 				}
 
 				// Create new Brivo credential for this user based on new Barcode ID
-				cred := GenerateStandardCredential(newBarcode, config.BrivoFacilityCode)
-				credID, err := cred.CreateCredential(config.BrivoAPIKey, auth.BrivoToken.AccessToken)
-				if err != nil {
-					return fmt.Errorf("Error creating credential for user %s with error: %s", brivoUser.ExternalID, err)
+				if config.IssuesWristband() {
+					if err := brivoUser.issueWristband(newBarcode, config, auth); err != nil {
+						return err
+					}
 				}
+			}
 
-				// Assign new credential to user
-				if err := brivoUser.AssignUserCredential(credID, config.BrivoAPIKey, auth.BrivoToken.AccessToken); err != nil {
-					return fmt.Errorf("Error assigning credential to user %s with error: %s", brivoUser.ExternalID, err)
+			// Custom fields are not sent with the user update
+			existingType, _ := GetFieldValue(config.BrivoUserTypeFieldID, existingUser.CustomFields)
+			newType, _ := GetFieldValue(config.BrivoUserTypeFieldID, brivoUser.CustomFields)
+			if existingType != newType {
+				if err := brivoUser.UpdateCustomField(config.BrivoUserTypeFieldID, newType, config.BrivoAPIKey, auth.BrivoToken.AccessToken); err != nil {
+					return fmt.Errorf("Error updating custom field for user %s with error: %s", brivoUser.ExternalID, err)
 				}
 			}
 			fmt.Printf("Brivo user %s updated successfully\n", brivoUser.ExternalID)
 		} else {
 			fmt.Printf("UserID %s does not have any properties to update\n", brivoUser.ExternalID)
 		}
+
+		// Store the deny reason for the front desk
+		currentReason, _ := GetFieldValue(config.BrivoReasonFieldID, existingUser.CustomFields)
+		if err := brivoUser.updateAccessReason(currentReason, decision.Reason, config, auth); err != nil {
+			return err
+		}
+
+		// Dependents share the payer's eligibility, so sync them again when it changes
+		if existingUser.Suspended != brivoUser.Suspended || (config.BrivoReasonFieldID != 0 && currentReason != decision.Reason) {
+			for _, dependentID := range decision.Dependents {
+				if err := scheduleRecheck(dependentID, time.Now(), &config, pool); err != nil {
+					fmt.Println(err)
+				}
+			}
+		}
+
+		// Store custom fields set by the policies and field mappings, such as the household link
+		if err := brivoUser.updateFields(existingUser.CustomFields, decision.Fields, config, auth); err != nil {
+			return err
+		}
+
+		// Update group memberships as the facility or MINDBODY memberships may have changed.
+		// Groups are left alone while the user does not have access
+		if decision.Allow {
+			if err := brivoUser.syncGroups(decision.Groups, config, auth); err != nil {
+				return err
+			}
+		}
+
+		// Update credential end dates as contracts may have been renewed or cancelled
+		if err := brivoUser.syncCredentialDates(client); err != nil {
+			return err
+		}
 		return nil
 	// Handle specific error codes from the API server
 	case *utils.JSONError:
@@ -168,9 +309,12 @@ func (event *Event) CreateOrUpdateUser(config Config, auth Auth) error {
 		}
 		// User does not exist: Create new user
 		if e.Code == 404 {
-			// Build event data into Brivo user
-			mbUser.buildUser(event.EventData)
+			// Build MINDBODY user into Brivo user
 			brivoUser.BuildUser(mbUser, config)
+			decision, err := brivoUser.applyPolicies(client)
+			if err != nil {
+				return err
+			}
 
 			// Create a new user
 			if err := brivoUser.CreateUser(config.BrivoAPIKey, auth.BrivoToken.AccessToken); err != nil {
@@ -189,25 +333,43 @@ func (event *Event) CreateOrUpdateUser(config Config, auth Auth) error {
 			}
 
 			// Add "Member" type to Brivo custom fields
-			if err := brivoUser.UpdateCustomField(config.BrivoUserTypeFieldID, "Member", config.BrivoAPIKey, auth.BrivoToken.AccessToken); err != nil {
+			if err := brivoUser.UpdateCustomField(config.BrivoUserTypeFieldID, UserTypeMember, config.BrivoAPIKey, auth.BrivoToken.AccessToken); err != nil {
 				return fmt.Errorf("Error updating custom field for user %s with error: %s", brivoUser.ExternalID, err)
 			}
 
 			// Create new Brivo credential for this user
-			cred := GenerateStandardCredential(barcodeID, config.BrivoFacilityCode)
-			credID, err := cred.CreateCredential(config.BrivoAPIKey, auth.BrivoToken.AccessToken)
-			if err != nil {
-				return fmt.Errorf("Error creating credential for user %s with error: %s", brivoUser.ExternalID, err)
+			if config.IssuesWristband() {
+				if err := brivoUser.issueWristband(barcodeID, config, auth); err != nil {
+					return err
+				}
+			}
+
+			// Send a mobile pass invitation to the user's email
+			if config.IssuesMobilePass() && !brivoUser.Suspended {
+				if err := brivoUser.IssueMobilePass(config.BrivoAPIKey, auth.BrivoToken.AccessToken); err != nil {
+					fmt.Printf("Error issuing mobile pass for user %s with error: %s\n", brivoUser.ExternalID, err)
+				}
+			}
+
+			// Store the deny reason for the front desk
+			if err := brivoUser.updateAccessReason("", decision.Reason, config, auth); err != nil {
+				return err
 			}
 
-			// Assign credential to user
-			if err := brivoUser.AssignUserCredential(credID, config.BrivoAPIKey, auth.BrivoToken.AccessToken); err != nil {
-				return fmt.Errorf("Error assigning credential to user %s with error: %s", brivoUser.ExternalID, err)
+			if err := brivoUser.updateFields(nil, decision.Fields, config, auth); err != nil {
+				return err
 			}
 
-			// Assign user to group
-			if err := brivoUser.AssignUserGroup(config.BrivoMemberGroupID, config.BrivoAPIKey, auth.BrivoToken.AccessToken); err != nil {
-				return fmt.Errorf("Error assigning user %s to group with error: %s", brivoUser.ExternalID, err)
+			// Assign user to the groups from the site's policies
+			for _, groupID := range decision.Groups {
+				if err := brivoUser.AssignUserGroup(groupID, config.BrivoAPIKey, auth.BrivoToken.AccessToken); err != nil {
+					return fmt.Errorf("Error assigning user %s to group %d with error: %s", brivoUser.ExternalID, groupID, err)
+				}
+			}
+
+			// Set credential end dates from the user's contracts
+			if err := brivoUser.syncCredentialDates(client); err != nil {
+				return err
 			}
 
 			fmt.Printf("Successfully created Brivo user %s\n", brivoUser.ExternalID)
@@ -220,11 +382,73 @@ func (event *Event) CreateOrUpdateUser(config Config, auth Auth) error {
 	}
 }
 
+// Sync the MINDBODY clients in the Redis sorted set `list` whose scheduled time has passed.
+// Members are keyed by barcode ID. Used to restore access once a hold ends or a balance is paid
+func resyncDue(tenant *Tenant, list string) {
+	config := tenant.Config
+	auth := &tenant.Auth
+
+	conn := tenant.Pool.Get()
+	defer conn.Close()
+
+	key := config.RedisKey(list)
+	ids, err := db.ZRangeByScore(key, time.Now().UTC().Unix(), conn)
+	if err != nil {
+		fmt.Printf("Redis: Error fetching %s: %s\n", list, err)
+		return
+	}
+
+	for _, id := range ids {
+		// Claim the user. Another process may have already picked them up
+		claimed, err := db.ZRem(key, id, conn)
+		if err != nil || !claimed {
+			continue
+		}
+
+		err = auth.refreshMindBodyToken(*config)
+		if err == nil {
+			var mbUser MindBodyUser
+			mbUser, err = GetClient(id, config, auth.MindBodyToken.AccessToken)
+			if err == nil {
+				tenant.RateLimit.Wait()
+				err = SyncUser(mbUser, *config, auth, tenant.Pool)
+			}
+		}
+		if err != nil {
+			fmt.Printf("Error syncing user %s from %s: %s\n", id, list, err)
+			// Try again on the next run
+			db.ZAdd(key, time.Now().UTC().Add(time.Minute).Unix(), id, conn)
+			continue
+		}
+		fmt.Printf("Synced user %s from %s\n", id, list)
+	}
+}
+
+// Create a barcode credential for the user and assign it
+func (user *BrivoUser) issueWristband(barcodeID string, config Config, auth *Auth) error {
+	barcode, err := config.ParseBarcode(barcodeID)
+	if err != nil {
+		return fmt.Errorf("Error parsing barcode ID for user %s with error: %s", user.ExternalID, err)
+	}
+	cred, err := config.CredentialGenerator.Generate(barcode)
+	if err != nil {
+		return fmt.Errorf("Error generating credential for user %s with error: %s", user.ExternalID, err)
+	}
+	credID, err := cred.CreateCredential(config.BrivoAPIKey, auth.BrivoToken.AccessToken)
+	if err != nil {
+		return fmt.Errorf("Error creating credential for user %s with error: %s", user.ExternalID, err)
+	}
+	if err := user.AssignUserCredential(credID, config.BrivoAPIKey, auth.BrivoToken.AccessToken); err != nil {
+		return fmt.Errorf("Error assigning credential to user %s with error: %s", user.ExternalID, err)
+	}
+	return nil
+}
+
 // DeactivateUser is a webhook event handler for client.deactivated
-func (event *Event) DeactivateUser(config Config, auth Auth) error {
+func (event *Event) DeactivateUser(config Config, auth *Auth, pool *redis.Pool) error {
 	// Query the user data on Brivo using the MINDBODY ClientUniqueID
 	var brivoUser BrivoUser
-	if err := brivoUser.getUserByExternalID(event.EventData.ClientUniqueID, config.BrivoAPIKey, auth.BrivoToken.AccessToken); err != nil {
+	if err := brivoUser.getUserByExternalID(strconv.Itoa(event.EventData.ClientUniqueID), config.BrivoAPIKey, auth.BrivoToken.AccessToken); err != nil {
 		return fmt.Errorf("Brivo user %d does not exist. Error: %s", event.EventData.ClientUniqueID, err)
 	}
 	// Put Brivo user in suspended status
@@ -234,37 +458,46 @@ func (event *Event) DeactivateUser(config Config, auth Auth) error {
 
 	fmt.Printf("Brivo user %s suspended status set to true\n", brivoUser.ExternalID)
 
-	return nil
+	// Revoke the user's mobile pass
+	if config.IssuesMobilePass() {
+		if err := brivoUser.RevokeMobilePass(config.BrivoAPIKey, auth.BrivoToken.AccessToken); err != nil {
+			return fmt.Errorf("Error revoking mobile pass for user %s: %s", brivoUser.ExternalID, err)
+		}
+	}
+
+	// Dependents share the payer's eligibility, so sync them again
+	var mbUser MindBodyUser
+	mbUser.buildUser(event.EventData)
+	return recheckDependents(mbUser, &config, auth, pool)
 }
 
 // Check current refreshing status and process new refresh token
-func doRefresh(errChan chan *Event, isRefreshing bool, config *Config, auth *Auth) {
-	if isRefreshing {
+func doRefresh(tenant *Tenant) {
+	if tenant.IsRefreshing {
 		return
 	}
 
 	// Lock the refresh sequence as there may be multiple routines attempting to refresh at once
-	mu.Lock()
-	isRefreshing = true
-
-	// Check that token hasn't already been refreshed
-	if time.Now().UTC().After(auth.BrivoToken.ExpireTime) {
-		if err := auth.BrivoToken.RefreshBrivoToken(*config); err != nil {
-			fmt.Println("Error refreshing Brivo AUTH token:\n", err)
-			return
-		}
-		utils.Logger("Refreshed Brivo AUTH token")
+	tenant.mu.Lock()
+	tenant.IsRefreshing = true
+
+	// The token is only refreshed if it hasn't already been refreshed
+	if err := tenant.Auth.refreshBrivoToken(*tenant.Config); err != nil {
+		fmt.Println(err)
+		tenant.IsRefreshing = false
+		tenant.mu.Unlock()
+		return
 	}
 
-	isRefreshing = false
-	mu.Unlock()
+	tenant.IsRefreshing = false
+	tenant.mu.Unlock()
 
 	// Listen for new events in the error channel
 loop:
 	for {
 		select {
-		case event := <-errChan:
-			go event.ProcessEvent(errChan, isRefreshing, config, auth)
+		case event := <-tenant.ErrChan:
+			go event.ProcessEvent(tenant)
 		default:
 			break loop
 		}
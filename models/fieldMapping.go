@@ -0,0 +1,249 @@
+// MINDBODY Field Mappings
+//
+// `brivo_field_mappings` copies MINDBODY client fields into Brivo custom fields.
+// Brivo custom fields, including the barcode and user type fields, are found by
+// name when the application starts. Mapped fields are stored on every sync when
+// their value has changed.
+
+package models
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Field mapping transforms
+const (
+	TransformUpper = "upper"
+	TransformLower = "lower"
+	TransformTitle = "title"
+	TransformDate  = "date"
+)
+
+// Sources that are not fields of the MINDBODY client record
+const (
+	sourceMemberships   = "Memberships"   // Names of the client's active memberships
+	sourceClientIndexes = "ClientIndexes" // Value ID of a client index. Eg: ClientIndexes.4
+)
+
+// FieldMapping copies a MINDBODY client field into a Brivo custom field
+type FieldMapping struct {
+	Field     string `json:"field"`     // Brivo custom field name
+	FieldID   int    `json:"fieldId"`   // Brivo custom field ID. Overrides the name lookup
+	Source    string `json:"source"`    // MINDBODY client field. Nested fields are separated by dots. Eg: HomeLocation.Name
+	Transform string `json:"transform"` // Optional: upper, lower, title or date
+}
+
+// CustomFieldDefinitions stores the custom fields defined in the Brivo account
+type CustomFieldDefinitions struct {
+	Data  []CustomFieldDefinition `json:"data"`
+	Count int                     `json:"count"`
+}
+
+// CustomFieldDefinition stores a single Brivo custom field definition
+type CustomFieldDefinition struct {
+	ID        int    `json:"id"`
+	FieldName string `json:"fieldName"`
+	FieldType string `json:"fieldType"`
+}
+
+// Check that the mapping's transform is supported
+func (mapping FieldMapping) validate() error {
+	switch mapping.Transform {
+	case "", TransformUpper, TransformLower, TransformTitle, TransformDate:
+	default:
+		return fmt.Errorf("Unknown transform %s for field %s", mapping.Transform, mapping.Field)
+	}
+	if mapping.Source == "" {
+		return fmt.Errorf("Missing source for field %s", mapping.Field)
+	}
+	return nil
+}
+
+// LoadCustomFields resolves the barcode, user type and mapped custom fields by name and
+// checks that every configured custom field exists in Brivo. Fields are only looked up
+// by name when no field ID is set
+func (config *Config) LoadCustomFields(brivoAPIKey string, brivoAccessToken string) error {
+	var fields CustomFieldDefinitions
+	if err := fields.ListCustomFields(brivoAPIKey, brivoAccessToken); err != nil {
+		return fmt.Errorf("Error fetching Brivo custom fields: %s", err)
+	}
+
+	type lookup struct {
+		id      *int
+		name    string
+		setting string
+	}
+	lookups := []lookup{
+		{&config.BrivoBarcodeFieldID, config.BrivoBarcodeFieldName, "brivo_barcode_field_id"},
+		{&config.BrivoUserTypeFieldID, config.BrivoUserTypeFieldName, "brivo_user_type_field_id"},
+	}
+	for i := range config.BrivoFieldMappings {
+		mapping := &config.BrivoFieldMappings[i]
+		lookups = append(lookups, lookup{&mapping.FieldID, mapping.Field, "fieldId in brivo_field_mappings"})
+	}
+	for _, field := range lookups {
+		if *field.id != 0 {
+			continue
+		}
+		id, err := fields.find(field.name, field.setting)
+		if err != nil {
+			return err
+		}
+		*field.id = id
+	}
+
+	// Check that configured field IDs exist
+	settings := map[string]int{
+		"brivo_barcode_field_id":   config.BrivoBarcodeFieldID,
+		"brivo_user_type_field_id": config.BrivoUserTypeFieldID,
+		"brivo_reason_field_id":    config.BrivoReasonFieldID,
+		"brivo_household_field_id": config.BrivoHouseholdFieldID,
+	}
+	for _, mapping := range config.BrivoFieldMappings {
+		if !fields.has(mapping.FieldID) {
+			return fmt.Errorf("Brivo custom field %d in brivo_field_mappings not found", mapping.FieldID)
+		}
+	}
+	for setting, fieldID := range settings {
+		if fieldID != 0 && !fields.has(fieldID) {
+			return fmt.Errorf("Brivo custom field %d in %s not found", fieldID, setting)
+		}
+	}
+	return nil
+}
+
+// Return the ID of the custom field named `name`. `setting` is suggested when the name is ambiguous
+func (fields CustomFieldDefinitions) find(name string, setting string) (int, error) {
+	var matches []CustomFieldDefinition
+	for _, field := range fields.Data {
+		if strings.EqualFold(field.FieldName, name) {
+			matches = append(matches, field)
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return 0, fmt.Errorf("Brivo custom field %q not found. Set %s", name, setting)
+	case 1:
+		return matches[0].ID, nil
+	}
+	return 0, fmt.Errorf("More than one Brivo custom field named %q. Set %s", name, setting)
+}
+
+// Check if the custom field with `fieldID` exists
+func (fields CustomFieldDefinitions) has(fieldID int) bool {
+	for _, field := range fields.Data {
+		if field.ID == fieldID {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the Brivo custom field values for the MINDBODY client keyed by field ID
+func (config *Config) mappedFields(client *ClientContext) (map[int]string, error) {
+	fields := make(map[int]string)
+	for _, mapping := range config.BrivoFieldMappings {
+		value, err := mapping.value(client)
+		if err != nil {
+			return nil, err
+		}
+		fields[mapping.FieldID] = value
+	}
+	return fields, nil
+}
+
+// Read the mapping's source from the MINDBODY client and apply the transform
+func (mapping FieldMapping) value(client *ClientContext) (string, error) {
+	var value string
+	path := strings.Split(mapping.Source, ".")
+	switch path[0] {
+	case sourceMemberships:
+		memberships, err := client.Memberships()
+		if err != nil {
+			return "", err
+		}
+		var names []string
+		for _, membership := range memberships {
+			names = append(names, membership.Name)
+		}
+		value = strings.Join(names, ", ")
+	case sourceClientIndexes:
+		// Webhook events do not include client indexes
+		details, err := client.Details()
+		if err != nil {
+			return "", err
+		}
+		indexID, _ := strconv.Atoi(strings.Join(path[1:], "."))
+		for _, index := range details.ClientIndexes {
+			if index.ID == indexID {
+				value = strconv.Itoa(index.ValueID)
+			}
+		}
+	default:
+		// Webhook events only include the client's name, contact details and status
+		raw := client.Client.raw
+		if raw == nil {
+			details, err := client.Details()
+			if err != nil {
+				return "", err
+			}
+			raw = details.raw
+		}
+		value = lookupField(raw, path)
+	}
+
+	switch mapping.Transform {
+	case TransformUpper:
+		value = strings.ToUpper(value)
+	case TransformLower:
+		value = strings.ToLower(value)
+	case TransformTitle:
+		value = strings.Title(strings.ToLower(value))
+	case TransformDate:
+		if t, err := client.config.parseMindBodyTime(value); err == nil {
+			value = t.Format("2006-01-02")
+		}
+	}
+	return value, nil
+}
+
+// Find the value at `path` in the MINDBODY client json. Lists are joined with commas
+func lookupField(raw map[string]interface{}, path []string) string {
+	var value interface{} = raw
+	for _, key := range path {
+		fields, ok := value.(map[string]interface{})
+		if !ok {
+			return ""
+		}
+		value = fields[key]
+	}
+	return formatField(value)
+}
+
+// Format a json value as a custom field value
+func formatField(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(v)
+	case []interface{}:
+		var values []string
+		for _, item := range v {
+			if s := formatField(item); s != "" {
+				values = append(values, s)
+			}
+		}
+		return strings.Join(values, ", ")
+	default:
+		b, _ := json.Marshal(v)
+		return string(b)
+	}
+}
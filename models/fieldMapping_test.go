@@ -0,0 +1,115 @@
+package models
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testClientJSON = `{
+	"Id": "100123",
+	"FirstName": "jane",
+	"HomeLocation": {"Id": 1, "Name": "Downtown"},
+	"CreationDate": "2018-05-04T09:30:00",
+	"AccountBalance": -12.5,
+	"IsCompany": false,
+	"Tags": ["Early Bird", "", "Swim"],
+	"EmergencyContactInfoName": null
+}`
+
+func TestLookupField(t *testing.T) {
+	var raw map[string]interface{}
+	if err := json.Unmarshal([]byte(testClientJSON), &raw); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		source string
+		want   string
+	}{
+		{"FirstName", "jane"},
+		{"HomeLocation.Name", "Downtown"},
+		{"HomeLocation.Id", "1"},
+		{"HomeLocation", `{"Id":1,"Name":"Downtown"}`},
+		{"AccountBalance", "-12.5"},
+		{"IsCompany", "false"},
+		{"Tags", "Early Bird, Swim"},
+		{"EmergencyContactInfoName", ""},
+		{"MissingField", ""},
+		{"FirstName.Missing", ""},
+	}
+
+	for _, test := range tests {
+		if got := lookupField(raw, strings.Split(test.source, ".")); got != test.want {
+			t.Errorf("%s: expected %q, got %q", test.source, test.want, got)
+		}
+	}
+}
+
+func TestFieldMappingTransforms(t *testing.T) {
+	config := &Config{MindbodyTimeZone: time.UTC, BrivoFieldMappings: []FieldMapping{{Field: "First Name", Source: "FirstName"}}}
+	var mb MindBody
+	if err := config.decodeClients([]byte(`{"Clients": [`+testClientJSON+`]}`), &mb); err != nil {
+		t.Fatal(err)
+	}
+	client := NewClientContext(mb.Clients[0], config, &Auth{})
+	memberships := []ClientMembership{{Name: "24/7 Membership"}, {Name: "Pool"}}
+	client.memberships = &ClientMemberships{ClientMemberships: memberships}
+
+	tests := []struct {
+		mapping FieldMapping
+		want    string
+	}{
+		{FieldMapping{Source: "FirstName"}, "jane"},
+		{FieldMapping{Source: "FirstName", Transform: TransformUpper}, "JANE"},
+		{FieldMapping{Source: "HomeLocation.Name", Transform: TransformLower}, "downtown"},
+		{FieldMapping{Source: "FirstName", Transform: TransformTitle}, "Jane"},
+		{FieldMapping{Source: "CreationDate", Transform: TransformDate}, "2018-05-04"},
+		{FieldMapping{Source: "FirstName", Transform: TransformDate}, "jane"},
+		{FieldMapping{Source: sourceMemberships, Transform: TransformUpper}, "24/7 MEMBERSHIP, POOL"},
+	}
+
+	for _, test := range tests {
+		got, err := test.mapping.value(client)
+		if err != nil {
+			t.Errorf("%s %s: unexpected error: %s", test.mapping.Source, test.mapping.Transform, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("%s %s: expected %q, got %q", test.mapping.Source, test.mapping.Transform, test.want, got)
+		}
+	}
+}
+
+func TestFieldMappingValidate(t *testing.T) {
+	tests := []struct {
+		mapping FieldMapping
+		valid   bool
+	}{
+		{FieldMapping{Field: "Home", Source: "HomeLocation.Name"}, true},
+		{FieldMapping{Field: "Home", Source: "HomeLocation.Name", Transform: TransformTitle}, true},
+		{FieldMapping{Field: "Home", Source: "HomeLocation.Name", Transform: "reverse"}, false},
+		{FieldMapping{Field: "Home"}, false},
+	}
+
+	for _, test := range tests {
+		if err := test.mapping.validate(); (err == nil) != test.valid {
+			t.Errorf("%+v: expected valid %t, got error %v", test.mapping, test.valid, err)
+		}
+	}
+}
+
+func TestDecodeClientsWithoutMappings(t *testing.T) {
+	var mb MindBody
+	config := &Config{}
+	if err := config.decodeClients([]byte(`{"Clients": [`+testClientJSON+`]}`), &mb); err != nil {
+		t.Fatal(err)
+	}
+	if len(mb.Clients) != 1 || mb.Clients[0].ID != "100123" {
+		t.Fatalf("expected client 100123, got %+v", mb.Clients)
+	}
+	if mb.Clients[0].raw != nil {
+		t.Errorf("expected the client json to be dropped without field mappings")
+	}
+}
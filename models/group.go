@@ -0,0 +1,303 @@
+// Brivo Group Data Model
+
+package models
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	utils "github.com/christophertino/mindbody-brivo"
+)
+
+// Groups stores the Brivo groups a user belongs to
+type Groups struct {
+	Data  []Group `json:"data"`
+	Count int     `json:"count"`
+}
+
+// Group stores a single Brivo group
+type Group struct {
+	ID   int    `json:"id"`
+	Name string `json:"name"`
+}
+
+// GroupRule assigns members to a Brivo group when they match any of the rule's
+// MINDBODY memberships, contracts or client indexes
+type GroupRule struct {
+	GroupID       int         `json:"groupId"`
+	Memberships   []string    `json:"memberships"`   // MINDBODY membership names
+	Contracts     []string    `json:"contracts"`     // MINDBODY contract names
+	ClientIndexes map[int]int `json:"clientIndexes"` // MINDBODY client index ID to value ID
+}
+
+// GetGroupsForUser retrieves the Brivo groups that userID is assigned to
+func (groups *Groups) GetGroupsForUser(userID int, brivoAPIKey string, brivoAccessToken string) error {
+	// Create HTTP request
+	req, err := http.NewRequest("GET", fmt.Sprintf("https://api.brivo.com/v1/api/users/%d/groups", userID), nil)
+	if err != nil {
+		return fmt.Errorf("Error creating HTTP request: %s", err)
+	}
+	req.Header.Add("Content-Type", "application/json")
+	req.Header.Add("Authorization", "Bearer "+brivoAccessToken)
+	req.Header.Add("api-key", brivoAPIKey)
+
+	if err = utils.DoRequest(req, groups); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// ListGroups fetches all groups in the Brivo account
+func (groups *Groups) ListGroups(brivoAPIKey string, brivoAccessToken string) error {
+	var (
+		count    = 0
+		pageSize = 100 // Max 100
+		results  []Group
+	)
+
+	for {
+		// Create HTTP request
+		req, err := http.NewRequest("GET", fmt.Sprintf("https://api.brivo.com/v1/api/groups?offset=%d&pageSize=%d", count, pageSize), nil)
+		if err != nil {
+			return fmt.Errorf("Error creating HTTP request: %s", err)
+		}
+		req.Header.Add("Content-Type", "application/json")
+		req.Header.Add("Authorization", "Bearer "+brivoAccessToken)
+		req.Header.Add("api-key", brivoAPIKey)
+
+		if err = utils.DoRequest(req, groups); err != nil {
+			return err
+		}
+
+		results = append(results, groups.Data...)
+		count += len(groups.Data)
+		if len(groups.Data) == 0 || count >= groups.Count {
+			break
+		}
+	}
+	groups.Data = results
+
+	return nil
+}
+
+// LoadGroups resolves the member group by name and checks that every configured
+// group exists in Brivo. The member group is only looked up when no group ID is set
+func (config *Config) LoadGroups(brivoAPIKey string, brivoAccessToken string) error {
+	var groups Groups
+	if err := groups.ListGroups(brivoAPIKey, brivoAccessToken); err != nil {
+		return fmt.Errorf("Error fetching Brivo groups: %s", err)
+	}
+
+	// Facilities built from brivo_facility_code without brivo_member_group_id use the member group name
+	for i := range config.BrivoFacilities {
+		for j, groupID := range config.BrivoFacilities[i].GroupIDs {
+			if groupID != 0 {
+				continue
+			}
+			if config.BrivoMemberGroupID == 0 {
+				id, err := groups.find(config.BrivoMemberGroupName, "brivo_member_group_id")
+				if err != nil {
+					return err
+				}
+				config.BrivoMemberGroupID = id
+			}
+			config.BrivoFacilities[i].GroupIDs[j] = config.BrivoMemberGroupID
+		}
+	}
+
+	// Check that configured group IDs exist
+	settings := map[string][]int{
+		"brivo_staff_group_id": {config.BrivoStaffGroupID},
+		"brivo_guest_group_id": {config.BrivoGuestGroupID},
+		"brivo_class_group_id": {config.BrivoClassGroupID},
+		"brivo_minor_group_id": {config.BrivoMinorGroupID},
+	}
+	for _, facility := range config.BrivoFacilities {
+		settings["brivo_facilities"] = append(settings["brivo_facilities"], facility.GroupIDs...)
+	}
+	for _, rule := range config.BrivoGroupRules {
+		settings["brivo_group_rules"] = append(settings["brivo_group_rules"], rule.GroupID)
+	}
+	for setting, groupIDs := range settings {
+		for _, groupID := range groupIDs {
+			if groupID != 0 && !groups.has(groupID) {
+				return fmt.Errorf("Brivo group %d in %s not found", groupID, setting)
+			}
+		}
+	}
+	return nil
+}
+
+// Return the ID of the group named `name`. `setting` is suggested when the name is ambiguous
+func (groups Groups) find(name string, setting string) (int, error) {
+	var matches []Group
+	for _, group := range groups.Data {
+		if strings.EqualFold(group.Name, name) {
+			matches = append(matches, group)
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return 0, fmt.Errorf("Brivo group %q not found. Set %s", name, setting)
+	case 1:
+		return matches[0].ID, nil
+	}
+	return 0, fmt.Errorf("More than one Brivo group named %q. Set %s", name, setting)
+}
+
+// Check if the group with `groupID` exists
+func (groups Groups) has(groupID int) bool {
+	for _, group := range groups.Data {
+		if group.ID == groupID {
+			return true
+		}
+	}
+	return false
+}
+
+// Assigns members to their facility's groups and any groups from matching group rules
+type groupPolicy struct{}
+
+func (groupPolicy) Name() string { return PolicyGroups }
+
+func (groupPolicy) Evaluate(client *ClientContext) (Decision, error) {
+	config := client.config
+	facility, _ := config.GetFacility(client.Client.ID)
+	decision := allow(append([]int{}, facility.GroupIDs...)...)
+	if len(config.BrivoGroupRules) == 0 {
+		return decision, nil
+	}
+
+	// Only fetch MINDBODY data that the rules need
+	var (
+		needMemberships bool
+		needContracts   bool
+		needIndexes     bool
+		memberships     = make(map[string]bool)
+		contracts       = make(map[string]bool)
+	)
+	for _, rule := range config.BrivoGroupRules {
+		needMemberships = needMemberships || len(rule.Memberships) > 0
+		needContracts = needContracts || len(rule.Contracts) > 0
+		needIndexes = needIndexes || len(rule.ClientIndexes) > 0
+	}
+	if needMemberships {
+		m, err := client.Memberships()
+		if err != nil {
+			return Decision{}, err
+		}
+		for _, membership := range m {
+			memberships[membership.Name] = true
+		}
+	}
+	if needContracts {
+		c, err := client.Contracts()
+		if err != nil {
+			return Decision{}, err
+		}
+		// Former members keep their expired contracts in MINDBODY
+		now := time.Now()
+		for _, contract := range c {
+			if config.isCurrentContract(contract, now) {
+				contracts[contract.ContractName] = true
+			}
+		}
+	}
+	// Webhook events do not include client indexes
+	clientIndexes := client.Client.ClientIndexes
+	if needIndexes && clientIndexes == nil {
+		details, err := client.Details()
+		if err != nil {
+			return Decision{}, err
+		}
+		clientIndexes = details.ClientIndexes
+	}
+	indexes := make(map[int]int)
+	for _, index := range clientIndexes {
+		indexes[index.ID] = index.ValueID
+	}
+
+	for _, rule := range config.BrivoGroupRules {
+		if rule.matches(memberships, contracts, indexes) {
+			decision.Groups = append(decision.Groups, rule.GroupID)
+		}
+	}
+
+	return decision, nil
+}
+
+// Check if any of the rule's conditions match the user's MINDBODY data
+func (rule GroupRule) matches(memberships map[string]bool, contracts map[string]bool, indexes map[int]int) bool {
+	for _, name := range rule.Memberships {
+		if memberships[name] {
+			return true
+		}
+	}
+	for _, name := range rule.Contracts {
+		if contracts[name] {
+			return true
+		}
+	}
+	for indexID, valueID := range rule.ClientIndexes {
+		if value, ok := indexes[indexID]; ok && value == valueID {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns all groups that are managed by the application. Users are only removed
+// from managed groups, so groups assigned manually in Brivo are left alone.
+func (config *Config) managedGroups() map[int]bool {
+	managed := make(map[int]bool)
+	for _, groupID := range config.MemberGroupIDs() {
+		managed[groupID] = true
+	}
+	for _, rule := range config.BrivoGroupRules {
+		managed[rule.GroupID] = true
+	}
+	return managed
+}
+
+// Add and remove the user's managed group memberships to match `groupIDs`
+func (user *BrivoUser) syncGroups(groupIDs []int, config Config, auth *Auth) error {
+	var groups Groups
+	if err := groups.GetGroupsForUser(user.ID, config.BrivoAPIKey, auth.BrivoToken.AccessToken); err != nil {
+		return fmt.Errorf("Error fetching groups for user %s: %s", user.ExternalID, err)
+	}
+	current := make(map[int]bool)
+	for _, group := range groups.Data {
+		current[group.ID] = true
+	}
+	target := make(map[int]bool)
+	for _, groupID := range groupIDs {
+		target[groupID] = true
+	}
+
+	// Add missing groups
+	for groupID := range target {
+		if current[groupID] {
+			continue
+		}
+		if err := user.AssignUserGroup(groupID, config.BrivoAPIKey, auth.BrivoToken.AccessToken); err != nil {
+			return fmt.Errorf("Error assigning user %s to group %d with error: %s", user.ExternalID, groupID, err)
+		}
+		fmt.Printf("Brivo user %s added to group %d\n", user.ExternalID, groupID)
+	}
+
+	// Remove managed groups the user no longer qualifies for
+	for groupID := range config.managedGroups() {
+		if !current[groupID] || target[groupID] {
+			continue
+		}
+		if err := user.RemoveUserGroup(groupID, config.BrivoAPIKey, auth.BrivoToken.AccessToken); err != nil {
+			return fmt.Errorf("Error removing user %s from group %d with error: %s", user.ExternalID, groupID, err)
+		}
+		fmt.Printf("Brivo user %s removed from group %d\n", user.ExternalID, groupID)
+	}
+
+	return nil
+}
@@ -0,0 +1,60 @@
+package models
+
+import (
+	"testing"
+	"time"
+)
+
+func TestGroupRuleMatches(t *testing.T) {
+	rule := GroupRule{
+		GroupID:       2001,
+		Memberships:   []string{"24/7 Membership"},
+		Contracts:     []string{"Off-Peak Annual"},
+		ClientIndexes: map[int]int{4: 12},
+	}
+
+	tests := []struct {
+		name        string
+		memberships map[string]bool
+		contracts   map[string]bool
+		indexes     map[int]int
+		want        bool
+	}{
+		{"no data", nil, nil, nil, false},
+		{"membership", map[string]bool{"24/7 Membership": true}, nil, nil, true},
+		{"other membership", map[string]bool{"Day Pass": true}, nil, nil, false},
+		{"contract", nil, map[string]bool{"Off-Peak Annual": true}, nil, true},
+		{"client index", nil, nil, map[int]int{4: 12}, true},
+		{"client index with other value", nil, nil, map[int]int{4: 13}, false},
+		{"other client index", nil, nil, map[int]int{5: 12}, false},
+	}
+
+	for _, test := range tests {
+		if got := rule.matches(test.memberships, test.contracts, test.indexes); got != test.want {
+			t.Errorf("%s: expected %t, got %t", test.name, test.want, got)
+		}
+	}
+}
+
+func TestIsCurrentContract(t *testing.T) {
+	config := &Config{MindbodyTimeZone: time.UTC}
+	now := time.Date(2019, 8, 15, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name     string
+		contract ClientContract
+		want     bool
+	}{
+		{"current", ClientContract{StartDate: "2019-01-01T00:00:00", EndDate: "2019-12-31T00:00:00"}, true},
+		{"ends today", ClientContract{StartDate: "2019-01-01T00:00:00", EndDate: "2019-08-15T00:00:00"}, true},
+		{"ended", ClientContract{StartDate: "2018-01-01T00:00:00", EndDate: "2019-08-14T00:00:00"}, false},
+		{"not started", ClientContract{StartDate: "2019-09-01T00:00:00", EndDate: "2020-08-31T00:00:00"}, false},
+		{"no end date", ClientContract{StartDate: "2019-01-01T00:00:00"}, true},
+	}
+
+	for _, test := range tests {
+		if got := config.isCurrentContract(test.contract, now); got != test.want {
+			t.Errorf("%s: expected %t, got %t", test.name, test.want, got)
+		}
+	}
+}
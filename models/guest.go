@@ -0,0 +1,259 @@
+// Guest Access
+//
+// Day-pass and class-pack customers do not have a wristband membership. When
+// MINDBODY records a sale of a configured guest product, the client is assigned
+// to the Brivo guest group until the access expires. Expiry times are stored in
+// a Redis sorted set and a scheduled job removes expired guests from the group.
+
+package models
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	db "github.com/christophertino/mindbody-brivo"
+	utils "github.com/christophertino/mindbody-brivo"
+	"github.com/gomodule/redigo/redis"
+)
+
+// UserTypeGuest is stored in the BrivoUserTypeFieldID custom field for guests
+const UserTypeGuest = "Guest"
+
+const guestList = "guests" // Sorted set of Brivo user IDs scored by access expiry
+
+// ClientSale stores MINDBODY sale data sent by clientSale.created webhook events
+type ClientSale struct {
+	SiteID             int        `json:"siteId"`
+	SaleID             int        `json:"saleId"`
+	PurchasingClientID string     `json:"purchasingClientId"`
+	Items              []SaleItem `json:"items"`
+}
+
+// SaleItem stores a single item of a MINDBODY sale
+type SaleItem struct {
+	ItemID            int    `json:"itemId"`
+	Type              string `json:"type"`
+	Name              string `json:"name"`
+	RecipientClientID string `json:"recipientClientId"` // Empty if the item was bought for the purchasing client
+}
+
+// ProcessSale is a webhook event handler for clientSale.created. Guest access is
+// granted for each item that matches `guest_products`
+func (event *Event) ProcessSale(tenant *Tenant) error {
+	config := tenant.Config
+	if config.BrivoGuestGroupID == 0 || len(config.GuestProducts) == 0 {
+		return nil
+	}
+
+	var sale ClientSale
+	if err := json.Unmarshal(event.RawEventData, &sale); err != nil {
+		return fmt.Errorf("Error parsing sale data: %s", err)
+	}
+
+	for _, item := range sale.Items {
+		duration, ok := config.guestDuration(item)
+		if !ok {
+			continue
+		}
+		clientID := item.RecipientClientID
+		if clientID == "" {
+			clientID = sale.PurchasingClientID
+		}
+		if err := grantGuestAccess(clientID, duration, config, &tenant.Auth, tenant.Pool); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Returns the access duration for the sale item. Products are matched by ID or name
+func (config *Config) guestDuration(item SaleItem) (time.Duration, bool) {
+	if d, ok := config.GuestProducts[strconv.Itoa(item.ItemID)]; ok {
+		return d.Duration, true
+	}
+	if d, ok := config.GuestProducts[item.Name]; ok {
+		return d.Duration, true
+	}
+	return 0, false
+}
+
+// Assign the MINDBODY client to the guest group and record when access expires. Clients
+// that do not have a Brivo user are created as guests
+func grantGuestAccess(clientID string, duration time.Duration, config *Config, auth *Auth, pool *redis.Pool) error {
+	if err := auth.refreshMindBodyToken(*config); err != nil {
+		return err
+	}
+	mbUser, err := GetClient(clientID, config, auth.MindBodyToken.AccessToken)
+	if err != nil {
+		return fmt.Errorf("Error fetching MINDBODY client %s: %s", clientID, err)
+	}
+
+	var user BrivoUser
+	err = user.getUserByExternalID(strconv.Itoa(mbUser.UniqueID), config.BrivoAPIKey, auth.BrivoToken.AccessToken)
+	switch e := err.(type) {
+	case nil:
+		// Lapsed members, and clients created as suspended members before the sale webhook
+		// was received, only have access as guests
+		if !mbUser.IsActive() {
+			if err := user.convertToGuest(*config, auth); err != nil {
+				return err
+			}
+		}
+	case *utils.JSONError:
+		// Unauthorized: Invalid token
+		if e.Code == 401 {
+			return fmt.Errorf("%d", http.StatusUnauthorized)
+		}
+		if e.Code != 404 {
+			return err
+		}
+		if err := user.createGuest(mbUser, *config, auth); err != nil {
+			return err
+		}
+	default:
+		return err
+	}
+
+	conn := pool.Get()
+	defer conn.Close()
+
+	// Keep the later expiry if the guest already has access
+	key := config.RedisKey(guestList)
+	member := strconv.Itoa(user.ID)
+	expires := time.Now().UTC().Add(duration).Unix()
+	current, err := db.ZScore(key, member, conn)
+	if err != nil {
+		return fmt.Errorf("Redis: Error fetching guest expiry for user %s: %s", user.ExternalID, err)
+	}
+	if current > expires {
+		expires = current
+	}
+
+	if err := user.AssignUserGroup(config.BrivoGuestGroupID, config.BrivoAPIKey, auth.BrivoToken.AccessToken); err != nil {
+		return fmt.Errorf("Error assigning user %s to group %d with error: %s", user.ExternalID, config.BrivoGuestGroupID, err)
+	}
+	if err := db.ZAdd(key, expires, member, conn); err != nil {
+		return fmt.Errorf("Redis: Error storing guest expiry for user %s: %s", user.ExternalID, err)
+	}
+
+	fmt.Printf("Brivo user %s granted guest access until %s\n", user.ExternalID, time.Unix(expires, 0).UTC().Format(time.RFC3339))
+	return nil
+}
+
+// Create a Brivo user for a guest. Guests are never suspended as access is controlled by the guest group
+func (user *BrivoUser) createGuest(mbUser MindBodyUser, config Config, auth *Auth) error {
+	user.BuildUser(mbUser, config)
+
+	if err := user.CreateUser(config.BrivoAPIKey, auth.BrivoToken.AccessToken); err != nil {
+		return fmt.Errorf("Error creating user %s with error: %s", user.ExternalID, err)
+	}
+	if err := user.UpdateCustomField(config.BrivoBarcodeFieldID, mbUser.ID, config.BrivoAPIKey, auth.BrivoToken.AccessToken); err != nil {
+		return fmt.Errorf("Error updating custom field for user %s with error: %s", user.ExternalID, err)
+	}
+	if err := user.UpdateCustomField(config.BrivoUserTypeFieldID, UserTypeGuest, config.BrivoAPIKey, auth.BrivoToken.AccessToken); err != nil {
+		return fmt.Errorf("Error updating custom field for user %s with error: %s", user.ExternalID, err)
+	}
+
+	// Guests can use their MINDBODY barcode if it is valid for the facility
+	if _, ok := config.GetFacility(mbUser.ID); ok && config.IssuesWristband() {
+		if err := user.issueWristband(mbUser.ID, config, auth); err != nil {
+			return err
+		}
+	}
+	if config.IssuesMobilePass() {
+		if err := user.IssueMobilePass(config.BrivoAPIKey, auth.BrivoToken.AccessToken); err != nil {
+			fmt.Printf("Error issuing mobile pass for user %s with error: %s\n", user.ExternalID, err)
+		}
+	}
+
+	fmt.Printf("Successfully created Brivo guest user %s\n", user.ExternalID)
+	return nil
+}
+
+// Convert an existing Brivo user who is not an active member into a guest. The user is
+// removed from the member groups so that their access ends when the guest access expires
+func (user *BrivoUser) convertToGuest(config Config, auth *Auth) error {
+	var customFields CustomFields
+	if err := customFields.GetCustomFieldsForUser(user.ID, config.BrivoAPIKey, auth.BrivoToken.AccessToken); err != nil {
+		return fmt.Errorf("Error fetching custom fields for user %s: %s", user.ExternalID, err)
+	}
+	if userType, _ := GetFieldValue(config.BrivoUserTypeFieldID, customFields.Data); userType != UserTypeGuest {
+		if err := user.syncGroups(nil, config, auth); err != nil {
+			return err
+		}
+		if err := user.UpdateCustomField(config.BrivoUserTypeFieldID, UserTypeGuest, config.BrivoAPIKey, auth.BrivoToken.AccessToken); err != nil {
+			return fmt.Errorf("Error updating custom field for user %s with error: %s", user.ExternalID, err)
+		}
+	}
+
+	// Guests are never suspended as access is controlled by the guest group
+	currentReason, _ := GetFieldValue(config.BrivoReasonFieldID, customFields.Data)
+	if err := user.updateAccessReason(currentReason, "", config, auth); err != nil {
+		return err
+	}
+	if user.Suspended {
+		if err := user.toggleSuspendedStatus(false, config.BrivoAPIKey, auth.BrivoToken.AccessToken); err != nil {
+			return fmt.Errorf("Error changing suspended status for user %s: %s", user.ExternalID, err)
+		}
+		user.Suspended = false
+		if config.IssuesMobilePass() {
+			if err := user.IssueMobilePass(config.BrivoAPIKey, auth.BrivoToken.AccessToken); err != nil {
+				fmt.Printf("Error issuing mobile pass for user %s with error: %s\n", user.ExternalID, err)
+			}
+		}
+	}
+
+	fmt.Printf("Brivo user %s converted to a guest\n", user.ExternalID)
+	return nil
+}
+
+// Returns true if the Brivo user has guest access that has not expired. Guest access
+// cannot be checked without a Redis pool
+func hasGuestAccess(userID int, config *Config, pool *redis.Pool) (bool, error) {
+	if pool == nil {
+		return false, nil
+	}
+	conn := pool.Get()
+	defer conn.Close()
+
+	expires, err := db.ZScore(config.RedisKey(guestList), strconv.Itoa(userID), conn)
+	if err != nil {
+		return false, fmt.Errorf("Redis: Error fetching guest expiry for user %d: %s", userID, err)
+	}
+	return expires > time.Now().UTC().Unix(), nil
+}
+
+// ExpireGuests removes guests from the guest group once their access has expired
+func ExpireGuests(config *Config, auth *Auth, pool *redis.Pool) {
+	conn := pool.Get()
+	defer conn.Close()
+
+	key := config.RedisKey(guestList)
+	ids, err := db.ZRangeByScore(key, time.Now().UTC().Unix(), conn)
+	if err != nil {
+		fmt.Printf("Redis: Error fetching expired guests: %s\n", err)
+		return
+	}
+
+	for _, id := range ids {
+		// Claim the expired guest. Another process may have already removed them
+		claimed, err := db.ZRem(key, id, conn)
+		if err != nil || !claimed {
+			continue
+		}
+
+		userID, _ := strconv.Atoi(id)
+		user := BrivoUser{ID: userID}
+		if err := user.RemoveUserGroup(config.BrivoGuestGroupID, config.BrivoAPIKey, auth.BrivoToken.AccessToken); err != nil {
+			fmt.Printf("Error removing guest user %d from group %d: %s\n", userID, config.BrivoGuestGroupID, err)
+			// Try again on the next run
+			db.ZAdd(key, time.Now().UTC().Unix(), id, conn)
+			continue
+		}
+		utils.Logger(fmt.Sprintf("Guest access expired for Brivo user %d", userID))
+	}
+}
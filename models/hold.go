@@ -0,0 +1,92 @@
+// Membership Holds
+//
+// Members who put their contract on hold in MINDBODY often keep an "Active" status.
+// The `hold` policy denies access for the hold period and asks for the member to be
+// synced again when the hold ends. Holds without an end date are checked again every
+// `mindbody_hold_recheck`.
+
+package models
+
+import (
+	"time"
+)
+
+// Denies access to members with a current contract hold or suspension period
+type holdPolicy struct{}
+
+func (holdPolicy) Name() string { return PolicyHold }
+
+func (holdPolicy) Evaluate(client *ClientContext) (Decision, error) {
+	end, onHold, err := currentHold(client)
+	if err != nil {
+		return Decision{}, err
+	}
+	if !onHold {
+		return allow(), nil
+	}
+	// Contracts on hold without a suspension period are checked again periodically
+	if end.IsZero() {
+		decision := deny("Contract is on hold")
+		decision.Recheck = time.Now().Add(client.config.MindbodyHoldRecheck.Duration)
+		return decision, nil
+	}
+	decision := deny("Contract is on hold until %s", end.Format("2006-01-02"))
+	decision.Recheck = end
+	return decision, nil
+}
+
+// Returns the end of the member's current contract hold. Returns false if the member is
+// not on hold, including when another current contract is not on hold. Holds without an
+// end date return a zero time
+func currentHold(client *ClientContext) (time.Time, bool, error) {
+	contracts, err := client.Contracts()
+	if err != nil {
+		return time.Time{}, false, err
+	}
+
+	var (
+		now       = time.Now()
+		end       time.Time
+		onHold    bool
+		openEnded bool
+	)
+	for _, contract := range contracts {
+		if !client.config.isCurrentContract(contract, now) {
+			continue
+		}
+		held := false
+		for _, suspension := range contract.Suspensions {
+			start, err := client.config.parseMindBodyTime(suspension.StartDate)
+			if err != nil {
+				continue
+			}
+			stop, err := client.config.parseMindBodyTime(suspension.EndDate)
+			if err != nil {
+				continue
+			}
+			// End dates are inclusive, so the hold lasts until the end of the day
+			stop = stop.AddDate(0, 0, 1)
+			if start.After(now) || !stop.After(now) {
+				continue
+			}
+			held = true
+			if stop.After(end) {
+				end = stop
+			}
+		}
+		if held {
+			onHold = true
+			continue
+		}
+		if contract.AutopayStatus == "Suspended" {
+			onHold, openEnded = true, true
+			continue
+		}
+		// The member still has access through this contract
+		return time.Time{}, false, nil
+	}
+	if openEnded {
+		return time.Time{}, onHold, nil
+	}
+	return end, onHold, nil
+}
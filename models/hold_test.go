@@ -0,0 +1,49 @@
+package models
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCurrentHold(t *testing.T) {
+	config := &Config{MindbodyTimeZone: time.UTC}
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	date := func(days int) string {
+		return today.AddDate(0, 0, days).Format(mindbodyTimeFormat)
+	}
+	held := ClientContract{
+		StartDate:   date(-30),
+		EndDate:     date(300),
+		Suspensions: []ContractSuspension{{StartDate: date(-2), EndDate: date(5)}},
+	}
+	autopaySuspended := ClientContract{StartDate: date(-30), EndDate: date(300), AutopayStatus: "Suspended"}
+	active := ClientContract{StartDate: date(-30), EndDate: date(300), AutopayStatus: "Active"}
+	ended := ClientContract{StartDate: date(-400), EndDate: date(-35), AutopayStatus: "Suspended"}
+
+	tests := []struct {
+		name      string
+		contracts []ClientContract
+		wantHold  bool
+		wantEnd   time.Time
+	}{
+		{"no contracts", nil, false, time.Time{}},
+		{"active", []ClientContract{active}, false, time.Time{}},
+		{"hold period", []ClientContract{held}, true, today.AddDate(0, 0, 6)},
+		{"autopay suspended", []ClientContract{autopaySuspended}, true, time.Time{}},
+		{"hold period and autopay suspended", []ClientContract{held, autopaySuspended}, true, time.Time{}},
+		{"hold period with another active contract", []ClientContract{held, active}, false, time.Time{}},
+		{"ended contract", []ClientContract{ended}, false, time.Time{}},
+	}
+
+	for _, test := range tests {
+		client := &ClientContext{config: config, contracts: &ClientContracts{Contracts: test.contracts}}
+		end, onHold, err := currentHold(client)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", test.name, err)
+			continue
+		}
+		if onHold != test.wantHold || !end.Equal(test.wantEnd) {
+			t.Errorf("%s: expected %t until %s, got %t until %s", test.name, test.wantHold, test.wantEnd, onHold, end)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+// Household Linking
+//
+// Family memberships in MINDBODY have a payer and dependents linked by client
+// relationships. The `household` policy gives dependents the same eligibility as
+// their payer, so dependents lose access when the payer's membership lapses even
+// though their own client records look active. `household_relationships` lists the
+// MINDBODY relationship names that link a payer and their dependents.
+
+package models
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// HouseholdRelationship names the roles of a MINDBODY client relationship. Each name
+// is the role of the related client as shown on the other client's record
+type HouseholdRelationship struct {
+	Payer     string `json:"payer"`     // Eg: Parent
+	Dependent string `json:"dependent"` // Eg: Child
+}
+
+// Policies that apply to the whole household. Personal policies such as waivers and
+// minors are only evaluated for the dependent
+var householdPolicies = map[string]bool{
+	PolicyStatus:     true,
+	PolicyMembership: true,
+	PolicyHold:       true,
+	PolicyBalance:    true,
+}
+
+// Denies access to dependents whose payer does not have access
+type householdPolicy struct{}
+
+func (householdPolicy) Name() string { return PolicyHousehold }
+
+func (householdPolicy) Evaluate(client *ClientContext) (Decision, error) {
+	config := client.config
+	payerID, dependents, err := client.Household()
+	if err != nil {
+		return Decision{}, err
+	}
+
+	decision := allow()
+	if payerID == "" {
+		if len(dependents) > 0 {
+			decision.setHouseholdField(config, fmt.Sprintf("Payer for %s", strings.Join(dependents, ", ")))
+		} else {
+			decision.setHouseholdField(config, "")
+		}
+		return decision, nil
+	}
+
+	// Evaluate the payer with the site's household policies
+	if err := client.auth.refreshMindBodyToken(*config); err != nil {
+		return Decision{}, err
+	}
+	payer, err := GetClient(payerID, config, client.auth.MindBodyToken.AccessToken)
+	if err != nil {
+		return Decision{}, fmt.Errorf("Error fetching household payer %s: %s", payerID, err)
+	}
+	var policies []Policy
+	for _, policy := range config.AccessPolicies {
+		if householdPolicies[policy.Name()] {
+			policies = append(policies, policy)
+		}
+	}
+	payerDecision, err := evaluate(policies, NewClientContext(payer, config, client.auth))
+	if err != nil {
+		return Decision{}, err
+	}
+
+	if !payerDecision.Allow {
+		decision = deny("Household payer %s %s does not have access: %s", payer.FirstName, payer.LastName, payerDecision.Reason)
+	}
+	decision.Recheck = payerDecision.Recheck
+	decision.setHouseholdField(config, fmt.Sprintf("Dependent of %s %s (%s)", payer.FirstName, payer.LastName, payer.ID))
+	return decision, nil
+}
+
+// Household returns the barcode IDs of the client's payer and dependents. The payer is
+// empty if the client is not a dependent
+func (client *ClientContext) Household() (string, []string, error) {
+	// Webhook events do not include client relationships
+	relationships := client.Client.ClientRelationships
+	if relationships == nil {
+		details, err := client.Details()
+		if err != nil {
+			return "", nil, err
+		}
+		relationships = details.ClientRelationships
+	}
+
+	var payerID string
+	var dependents []string
+	for _, relationship := range relationships {
+		for _, household := range client.config.HouseholdRelationships {
+			switch relationship.RelationshipName {
+			case household.Payer:
+				if payerID == "" {
+					payerID = relationship.RelatedClientID
+				}
+			case household.Dependent:
+				dependents = append(dependents, relationship.RelatedClientID)
+			}
+		}
+	}
+	return payerID, dependents, nil
+}
+
+// Queue the client's dependents to be synced again, as they share the client's eligibility.
+// Used when a payer is suspended outside of SyncUser
+func recheckDependents(mbUser MindBodyUser, config *Config, auth *Auth, pool *redis.Pool) error {
+	if config.findPolicy(PolicyHousehold) == nil {
+		return nil
+	}
+	_, dependents, err := NewClientContext(mbUser, config, auth).Household()
+	if err != nil {
+		return fmt.Errorf("Error fetching dependents of user %s: %s", mbUser.ID, err)
+	}
+	for _, dependentID := range dependents {
+		if err := scheduleRecheck(dependentID, time.Now(), config, pool); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Show the household link in the household custom field
+func (decision *Decision) setHouseholdField(config *Config, value string) {
+	if config.BrivoHouseholdFieldID == 0 {
+		return
+	}
+	decision.Fields = map[int]string{config.BrivoHouseholdFieldID: value}
+}
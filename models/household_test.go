@@ -0,0 +1,45 @@
+package models
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDecideHouseholdPayer(t *testing.T) {
+	config := &Config{
+		HouseholdRelationships: []HouseholdRelationship{{Payer: "Parent", Dependent: "Child"}},
+	}
+	for _, name := range []string{PolicyStatus, PolicyHousehold} {
+		policy, _ := NewPolicy(name)
+		config.AccessPolicies = append(config.AccessPolicies, policy)
+	}
+	relationships := []ClientRelationship{
+		{RelatedClientID: "100200", RelationshipName: "Child"},
+		{RelatedClientID: "100300", RelationshipName: "Child"},
+		{RelatedClientID: "100400", RelationshipName: "Friend"},
+	}
+
+	tests := []struct {
+		name      string
+		payer     MindBodyUser
+		wantAllow bool
+	}{
+		{"active payer", MindBodyUser{ID: "100100", Active: true, Status: "Active", ClientRelationships: relationships}, true},
+		{"payer denied by status", MindBodyUser{ID: "100100", Active: true, Status: "Expired", ClientRelationships: relationships}, false},
+	}
+
+	for _, test := range tests {
+		client := NewClientContext(test.payer, config, &Auth{})
+		decision, err := client.decide()
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", test.name, err)
+			continue
+		}
+		if decision.Allow != test.wantAllow {
+			t.Errorf("%s: expected allow %t, got %t", test.name, test.wantAllow, decision.Allow)
+		}
+		if want := []string{"100200", "100300"}; !reflect.DeepEqual(decision.Dependents, want) {
+			t.Errorf("%s: expected dependents %v, got %v", test.name, want, decision.Dependents)
+		}
+	}
+}
@@ -8,10 +8,20 @@ import (
 	"fmt"
 	"net/http"
 	"regexp"
+	"strings"
+	"time"
 
 	utils "github.com/christophertino/mindbody-brivo"
 )
 
+// MINDBODY dates are sent in the local time of the site without a timezone
+const mindbodyTimeFormat = "2006-01-02T15:04:05"
+
+// Parse a MINDBODY date in the time zone of the site
+func (config *Config) parseMindBodyTime(value string) (time.Time, error) {
+	return time.ParseInLocation(mindbodyTimeFormat, value, config.timeZone())
+}
+
 // MindBody Client Data
 type MindBody struct {
 	PaginationResponse struct {
@@ -25,23 +35,188 @@ type MindBody struct {
 
 // MindBodyUser stores MINDBODY user data
 type MindBodyUser struct {
-	ID          string `json:"Id"`       // Client’s public barcode ID used for client-related API calls (this is changeable)
-	UniqueID    int    `json:"UniqueId"` // Client’s unique system-generated ID (does not change)
-	FirstName   string `json:"FirstName"`
-	MiddleName  string `json:"MiddleName"`
-	LastName    string `json:"LastName"`
-	Email       string `json:"Email"`
-	MobilePhone string `json:"MobilePhone"`
-	HomePhone   string `json:"HomePhone"`
-	WorkPhone   string `json:"WorkPhone"`
-	Active      bool   `json:"Active"`
-	Status      string `json:"Status"` // Declined,Non-Member,Active,Expired,Suspended,Terminated
+	ID             string        `json:"Id"`       // Client’s public barcode ID used for client-related API calls (this is changeable)
+	UniqueID       int           `json:"UniqueId"` // Client’s unique system-generated ID (does not change)
+	FirstName      string        `json:"FirstName"`
+	MiddleName     string        `json:"MiddleName"`
+	LastName       string        `json:"LastName"`
+	Email          string        `json:"Email"`
+	MobilePhone    string        `json:"MobilePhone"`
+	HomePhone      string        `json:"HomePhone"`
+	WorkPhone      string        `json:"WorkPhone"`
+	BirthDate      string        `json:"BirthDate"`
+	Active         bool          `json:"Active"`
+	Status         string        `json:"Status"`         // Declined,Non-Member,Active,Expired,Suspended,Terminated
+	AccountBalance float64       `json:"AccountBalance"` // Negative balances are owed by the client
+	YellowAlert    string        `json:"YellowAlert"`
+	ClientIndexes  []ClientIndex `json:"ClientIndexes"`
+	Liability      Liability     `json:"Liability"`
+
+	ClientRelationships []ClientRelationship `json:"ClientRelationships"`
+
+	raw map[string]interface{} // Full client json used by field mappings
+}
+
+// Decode a page of MINDBODY clients. The full client json is only kept when the site has
+// field mappings, so that any client field can be mapped to a Brivo custom field
+func (config *Config) decodeClients(data []byte, mb *MindBody) error {
+	if err := json.Unmarshal(data, mb); err != nil {
+		return fmt.Errorf("Error unmarshalling json: %s", err)
+	}
+	if len(config.BrivoFieldMappings) == 0 {
+		return nil
+	}
+	var raw struct {
+		Clients []map[string]interface{} `json:"Clients"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return fmt.Errorf("Error unmarshalling json: %s", err)
+	}
+	for i := range mb.Clients {
+		if i < len(raw.Clients) {
+			mb.Clients[i].raw = raw.Clients[i]
+		}
+	}
+	return nil
+}
+
+// ClientRelationship links a MINDBODY client to a related client, such as a family member
+type ClientRelationship struct {
+	RelatedClientID  string `json:"RelatedClientId"`  // Barcode ID of the related client
+	RelationshipName string `json:"RelationshipName"` // Role of the related client
+}
+
+// Liability stores the MINDBODY liability waiver status of a client
+type Liability struct {
+	IsReleased    bool   `json:"IsReleased"` // True once the liability release has been signed
+	AgreementDate string `json:"AgreementDate"`
+	ReleasedBy    int    `json:"ReleasedBy"`
+}
+
+// IsActive returns true if the client's MINDBODY status is active
+func (mbUser *MindBodyUser) IsActive() bool {
+	return mbUser.Active && mbUser.Status == "Active"
+}
+
+// ClientIndex stores the value assigned to a MINDBODY client index
+type ClientIndex struct {
+	ID      int `json:"Id"`
+	ValueID int `json:"ValueId"`
+}
+
+// ClientMemberships stores the active memberships for a MINDBODY client
+type ClientMemberships struct {
+	ClientMemberships []ClientMembership `json:"ClientMemberships"`
+}
+
+// ClientMembership stores a single MINDBODY membership
+type ClientMembership struct {
+	ID           int    `json:"Id"`
+	MembershipID int    `json:"MembershipId"`
+	Name         string `json:"Name"`
+	Current      bool   `json:"Current"`
+}
+
+// ClientContracts stores the contracts for a MINDBODY client
+type ClientContracts struct {
+	Contracts []ClientContract `json:"Contracts"`
+}
+
+// ClientContract stores a single MINDBODY contract
+type ClientContract struct {
+	ID           int    `json:"Id"`
+	ContractID   int    `json:"ContractID"`
+	ContractName string `json:"ContractName"`
+	StartDate    string `json:"StartDate"`
+	EndDate      string `json:"EndDate"`
+	// Hold and suspension periods. AutopayStatus is "Suspended" while the contract is on hold
+	// and "Failed" when the last autopay could not be charged
+	AutopayStatus string               `json:"AutopayStatus"`
+	Suspensions   []ContractSuspension `json:"ContractSuspensions"`
+}
+
+// Returns true if the contract has started and has not ended at `now`. End dates are
+// inclusive, so the contract lasts until the end of the day. Contracts without an end
+// date do not end
+func (config *Config) isCurrentContract(contract ClientContract, now time.Time) bool {
+	if start, err := config.parseMindBodyTime(contract.StartDate); err == nil && start.After(now) {
+		return false
+	}
+	if end, err := config.parseMindBodyTime(contract.EndDate); err == nil && !end.AddDate(0, 0, 1).After(now) {
+		return false
+	}
+	return true
+}
+
+// Returns true if the pricing option is active and has not expired at `now`. Pricing
+// options without an expiration date do not expire
+func (config *Config) isCurrentService(service ClientService, now time.Time) bool {
+	if start, err := config.parseMindBodyTime(service.ActiveDate); err == nil && start.After(now) {
+		return false
+	}
+	if end, err := config.parseMindBodyTime(service.ExpirationDate); err == nil && !end.AddDate(0, 0, 1).After(now) {
+		return false
+	}
+	return true
+}
+
+// ContractSuspension stores a hold or suspension period of a MINDBODY contract
+type ContractSuspension struct {
+	SuspensionType string `json:"SuspensionType"`
+	StartDate      string `json:"SuspensionStartDate"`
+	EndDate        string `json:"SuspensionEndDate"`
+}
+
+// ClientServices stores the pricing options for a MINDBODY client
+type ClientServices struct {
+	ClientServices []ClientService `json:"ClientServices"`
+}
+
+// ClientService stores a single MINDBODY pricing option
+type ClientService struct {
+	ID             int    `json:"Id"`
+	Name           string `json:"Name"`
+	ActiveDate     string `json:"ActiveDate"`
+	ExpirationDate string `json:"ExpirationDate"`
+	Current        bool   `json:"Current"`
+	Remaining      int    `json:"Remaining"`
+}
+
+// ClientVisits stores the visit history for a MINDBODY client
+type ClientVisits struct {
+	Visits []ClientVisit `json:"Visits"`
+}
+
+// ClientVisit stores a single MINDBODY visit. Arrivals are recorded as visits
+// that are not attached to a class or appointment
+type ClientVisit struct {
+	ID            int    `json:"Id"`
+	ClientID      string `json:"ClientId"`
+	LocationID    int    `json:"LocationId"`
+	ClassID       int    `json:"ClassId"`
+	AppointmentID int    `json:"AppointmentId"`
+	Name          string `json:"Name"`
+	StartDateTime string `json:"StartDateTime"`
+}
+
+// Returns true if the visit was recorded by an arrival rather than a class or appointment
+func (visit ClientVisit) isArrival() bool {
+	return visit.ClassID == 0 && visit.AppointmentID == 0
 }
 
 // Client arrival information
 type clientArrival struct {
-	ClientID   string `json:"ClientId"`
-	LocationID int    `json:"LocationId"`
+	ClientID      string `json:"ClientId"`
+	LocationID    int    `json:"LocationId"`
+	ArrivalTypeID int    `json:"ArrivalTypeId,omitempty"`
+}
+
+// Client update information
+type clientUpdate struct {
+	Client struct {
+		ID          string `json:"Id"`
+		YellowAlert string `json:"YellowAlert,omitempty"`
+	} `json:"Client"`
 }
 
 // GetClients builds the MINDBODY data model with client data
@@ -65,7 +240,11 @@ func (mb *MindBody) GetClients(config Config, mbAccessToken string) error {
 		req.Header.Add("Api-Key", config.MindbodyAPIKey)
 		req.Header.Add("Authorization", mbAccessToken)
 
-		if err = utils.DoRequest(req, mb); err != nil {
+		var body json.RawMessage
+		if err = utils.DoRequest(req, &body); err != nil {
+			return err
+		}
+		if err = config.decodeClients(body, mb); err != nil {
 			return err
 		}
 
@@ -74,7 +253,7 @@ func (mb *MindBody) GetClients(config Config, mbAccessToken string) error {
 		results = append(results, mb.Clients...)
 		count += mb.PaginationResponse.PageSize
 
-		if count >= mb.PaginationResponse.TotalResults {
+		if mb.PaginationResponse.PageSize == 0 || count >= mb.PaginationResponse.TotalResults {
 			break
 		}
 	}
@@ -91,8 +270,9 @@ func (mb *MindBody) GetClients(config Config, mbAccessToken string) error {
 func AddArrival(barcodeID string, config *Config, mbAccessToken string) error {
 	// Build request body JSON
 	bytesMessage, err := json.Marshal(clientArrival{
-		ClientID:   barcodeID,
-		LocationID: config.MindbodyLocationID,
+		ClientID:      barcodeID,
+		LocationID:    config.MindbodyLocationID,
+		ArrivalTypeID: config.MindbodyArrivalTypeID,
 	})
 	if err != nil {
 		return fmt.Errorf("Error building request body json: %s", err)
@@ -110,7 +290,8 @@ func AddArrival(barcodeID string, config *Config, mbAccessToken string) error {
 
 	var r map[string]interface{}
 	if err = utils.DoRequest(req, &r); err != nil {
-		return err
+		// Business errors are returned as *ArrivalError
+		return parseArrivalError(err)
 	}
 
 	utils.Logger(fmt.Sprintf("Added arrival for user %s", barcodeID))
@@ -118,6 +299,179 @@ func AddArrival(barcodeID string, config *Config, mbAccessToken string) error {
 	return nil
 }
 
+// AddClientAlert adds `alert` to the yellow alert for the MINDBODY client with `barcodeID`.
+// Existing alerts are kept and the alert is not added again if it is already there
+func AddClientAlert(barcodeID string, alert string, config *Config, mbAccessToken string) error {
+	mbUser, err := GetClient(barcodeID, config, mbAccessToken)
+	if err != nil {
+		return fmt.Errorf("Error fetching MINDBODY client %s: %s", barcodeID, err)
+	}
+	if strings.Contains(mbUser.YellowAlert, alert) {
+		return nil
+	}
+	if mbUser.YellowAlert != "" {
+		alert = mbUser.YellowAlert + "\n" + alert
+	}
+
+	// Build request body JSON
+	var update clientUpdate
+	update.Client.ID = barcodeID
+	update.Client.YellowAlert = alert
+	bytesMessage, err := json.Marshal(update)
+	if err != nil {
+		return fmt.Errorf("Error building request body json: %s", err)
+	}
+
+	// Create HTTP request
+	req, err := http.NewRequest("POST", "https://api.mindbodyonline.com/public/v6/client/updateclient", bytes.NewBuffer(bytesMessage))
+	if err != nil {
+		return fmt.Errorf("Error creating HTTP request: %s", err)
+	}
+	req.Header.Add("Content-Type", "application/json")
+	req.Header.Add("SiteId", config.MindbodySite)
+	req.Header.Add("Api-Key", config.MindbodyAPIKey)
+	req.Header.Add("Authorization", mbAccessToken)
+
+	var r map[string]interface{}
+	if err = utils.DoRequest(req, &r); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// GetClient fetches a single MINDBODY client by `barcodeID`
+func GetClient(barcodeID string, config *Config, mbAccessToken string) (MindBodyUser, error) {
+	// Create HTTP request
+	req, err := http.NewRequest("GET", fmt.Sprintf("https://api.mindbodyonline.com/public/v6/client/clients?clientIds=%s", barcodeID), nil)
+	if err != nil {
+		return MindBodyUser{}, fmt.Errorf("Error creating HTTP request: %s", err)
+	}
+	req.Header.Add("Content-Type", "application/json")
+	req.Header.Add("SiteId", config.MindbodySite)
+	req.Header.Add("Api-Key", config.MindbodyAPIKey)
+	req.Header.Add("Authorization", mbAccessToken)
+
+	var body json.RawMessage
+	if err = utils.DoRequest(req, &body); err != nil {
+		return MindBodyUser{}, err
+	}
+	var mb MindBody
+	if err = config.decodeClients(body, &mb); err != nil {
+		return MindBodyUser{}, err
+	}
+	if len(mb.Clients) == 0 {
+		return MindBodyUser{}, fmt.Errorf("MINDBODY client %s not found", barcodeID)
+	}
+
+	return mb.Clients[0], nil
+}
+
+// GetClientContracts fetches the contracts for the MINDBODY client with `barcodeID`
+func (contracts *ClientContracts) GetClientContracts(barcodeID string, config *Config, mbAccessToken string) error {
+	// Create HTTP request
+	req, err := http.NewRequest("GET", fmt.Sprintf("https://api.mindbodyonline.com/public/v6/client/clientcontracts?clientId=%s", barcodeID), nil)
+	if err != nil {
+		return fmt.Errorf("Error creating HTTP request: %s", err)
+	}
+	req.Header.Add("Content-Type", "application/json")
+	req.Header.Add("SiteId", config.MindbodySite)
+	req.Header.Add("Api-Key", config.MindbodyAPIKey)
+	req.Header.Add("Authorization", mbAccessToken)
+
+	if err = utils.DoRequest(req, contracts); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// GetClientServices fetches the pricing options for the MINDBODY client with `barcodeID`
+func (services *ClientServices) GetClientServices(barcodeID string, config *Config, mbAccessToken string) error {
+	// Create HTTP request
+	req, err := http.NewRequest("GET", fmt.Sprintf("https://api.mindbodyonline.com/public/v6/client/clientservices?clientId=%s", barcodeID), nil)
+	if err != nil {
+		return fmt.Errorf("Error creating HTTP request: %s", err)
+	}
+	req.Header.Add("Content-Type", "application/json")
+	req.Header.Add("SiteId", config.MindbodySite)
+	req.Header.Add("Api-Key", config.MindbodyAPIKey)
+	req.Header.Add("Authorization", mbAccessToken)
+
+	if err = utils.DoRequest(req, services); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// GetActiveMemberships fetches the active memberships for the MINDBODY client with `barcodeID`
+func (memberships *ClientMemberships) GetActiveMemberships(barcodeID string, config *Config, mbAccessToken string) error {
+	// Create HTTP request
+	req, err := http.NewRequest("GET", fmt.Sprintf("https://api.mindbodyonline.com/public/v6/client/activeclientmemberships?clientId=%s", barcodeID), nil)
+	if err != nil {
+		return fmt.Errorf("Error creating HTTP request: %s", err)
+	}
+	req.Header.Add("Content-Type", "application/json")
+	req.Header.Add("SiteId", config.MindbodySite)
+	req.Header.Add("Api-Key", config.MindbodyAPIKey)
+	req.Header.Add("Authorization", mbAccessToken)
+
+	if err = utils.DoRequest(req, memberships); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// GetClientVisits fetches the visits for the MINDBODY client with `barcodeID` between
+// `startDate` and `endDate`. Dates use the YYYY-MM-DD format in the site's local time
+func (visits *ClientVisits) GetClientVisits(barcodeID string, startDate string, endDate string, config *Config, mbAccessToken string) error {
+	// Create HTTP request
+	req, err := http.NewRequest("GET", fmt.Sprintf("https://api.mindbodyonline.com/public/v6/client/clientvisits?clientId=%s&startDate=%s&endDate=%s", barcodeID, startDate, endDate), nil)
+	if err != nil {
+		return fmt.Errorf("Error creating HTTP request: %s", err)
+	}
+	req.Header.Add("Content-Type", "application/json")
+	req.Header.Add("SiteId", config.MindbodySite)
+	req.Header.Add("Api-Key", config.MindbodyAPIKey)
+	req.Header.Add("Authorization", mbAccessToken)
+
+	if err = utils.DoRequest(req, visits); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// HasRecentVisit checks the MINDBODY visit history to see if the client with `barcodeID`
+// already has an arrival at the configured location that started within `window` of now.
+// Class and appointment visits are not counted, so they do not replace a door arrival
+func HasRecentVisit(barcodeID string, window time.Duration, config *Config, mbAccessToken string) (bool, error) {
+	// Visit dates are in the time zone of the MINDBODY site
+	now := time.Now().In(config.timeZone())
+	since := now.Add(-window)
+	startDate := since.Format("2006-01-02")
+	endDate := now.AddDate(0, 0, 1).Format("2006-01-02")
+
+	var visits ClientVisits
+	if err := visits.GetClientVisits(barcodeID, startDate, endDate, config, mbAccessToken); err != nil {
+		return false, err
+	}
+	for _, visit := range visits.Visits {
+		if visit.LocationID != config.MindbodyLocationID || !visit.isArrival() {
+			continue
+		}
+		start, err := config.parseMindBodyTime(visit.StartDateTime)
+		if err != nil || start.After(now) || start.Before(since) {
+			continue
+		}
+		utils.Logger(fmt.Sprintf("Found MINDBODY visit %d for user %s at location %d", visit.ID, barcodeID, visit.LocationID))
+		return true, nil
+	}
+	return false, nil
+}
+
 // Build MINDBODY user from webhook EventUserData
 func (mbUser *MindBodyUser) buildUser(eventData EventUserData) {
 	mbUser.ID = eventData.ClientID
@@ -131,19 +485,7 @@ func (mbUser *MindBodyUser) buildUser(eventData EventUserData) {
 	mbUser.WorkPhone = eventData.WorkPhone
 	mbUser.Active = (eventData.Status == "Active")
 	mbUser.Status = eventData.Status
-}
-
-// IsValidID checks to make sure MindBodyUser.ID and EventUserData.ClientID
-// follow the correct ID format of XX-XXXXX, where the first two digits are the
-// Brivo facility code. If the ID value does not validate, that means the user has
-// not been assigned a MINDBODY security bracelet and should not be added to Brivo.
-func IsValidID(facilityCode int, barcodeID string) bool {
-	pattern := fmt.Sprintf("^%d-[0-9]{5}$", facilityCode)
-	match, err := regexp.MatchString(pattern, barcodeID)
-	if err != nil {
-		return false
-	}
-	return match
+	mbUser.BirthDate = eventData.BirthDateTime
 }
 
 // IsValidHexID checks for a valid 8 digit hex value
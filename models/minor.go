@@ -0,0 +1,60 @@
+// Minor Access
+//
+// The `minor` policy applies to members younger than `minor_age`. Minors are assigned
+// to the Brivo minor group instead of their facility's groups, so they only have access
+// during the group's supervised schedule. If `brivo_minor_group_id` is not set, minors
+// are denied access. Members are synced again when they come of age so that they are
+// moved into the adult groups.
+
+package models
+
+import (
+	"fmt"
+	"time"
+)
+
+// Assigns minors to the minor group, or denies access if there is no minor group
+type minorPolicy struct{}
+
+func (minorPolicy) Name() string { return PolicyMinor }
+
+func (minorPolicy) Evaluate(client *ClientContext) (Decision, error) {
+	adult, minor := client.config.minorUntil(client.Client)
+	if !minor {
+		return allow(), nil
+	}
+
+	var decision Decision
+	if client.config.BrivoMinorGroupID == 0 {
+		decision = deny("Minor until %s", adult.Format("2006-01-02"))
+	} else {
+		decision = allow(client.config.BrivoMinorGroupID)
+		decision.Exclusive = true
+	}
+	decision.Recheck = adult
+	return decision, nil
+}
+
+// Returns the date the member comes of age. Returns false if the member is not a minor
+// or their birth date is unknown
+func (config *Config) minorUntil(mbUser MindBodyUser) (time.Time, bool) {
+	if config.MinorAge == 0 || mbUser.BirthDate == "" {
+		return time.Time{}, false
+	}
+	birthDate, err := config.parseBirthDate(mbUser.BirthDate)
+	if err != nil {
+		fmt.Printf("Invalid birth date %s for user %s: %s\n", mbUser.BirthDate, mbUser.ID, err)
+		return time.Time{}, false
+	}
+	adult := birthDate.AddDate(config.MinorAge, 0, 0)
+	return adult, time.Now().Before(adult)
+}
+
+// Parse a MINDBODY birth date. Webhook events may include a UTC offset, but the birth
+// date is always the calendar date in the site's time zone
+func (config *Config) parseBirthDate(value string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, config.timeZone()), nil
+	}
+	return config.parseMindBodyTime(value)
+}
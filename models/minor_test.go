@@ -0,0 +1,32 @@
+package models
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseBirthDate(t *testing.T) {
+	site := time.FixedZone("EST", -5*60*60)
+	config := &Config{MindbodyTimeZone: site}
+	want := time.Date(2005, 3, 14, 0, 0, 0, 0, site)
+
+	tests := []struct {
+		name  string
+		value string
+	}{
+		{"MINDBODY date", "2005-03-14T00:00:00"},
+		{"webhook date with offset", "2005-03-14T00:00:00Z"},
+		{"webhook date with other offset", "2005-03-14T00:00:00+09:00"},
+	}
+
+	for _, test := range tests {
+		got, err := config.parseBirthDate(test.value)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", test.name, err)
+			continue
+		}
+		if !got.Equal(want) {
+			t.Errorf("%s: expected %s, got %s", test.name, want, got)
+		}
+	}
+}
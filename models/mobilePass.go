@@ -0,0 +1,110 @@
+// Brivo Mobile Pass
+//
+// Mobile passes are sent to the member's email as a Brivo digital credential
+// invitation. They are tracked separately from the barcode credential using
+// a ReferenceID of `mobile-<ExternalID>`.
+// See https://apidocs.brivo.com/#api-Credential-CreateDigitalCredentialInvitation
+
+package models
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	utils "github.com/christophertino/mindbody-brivo"
+)
+
+// Supported values for `brivo_mobile_pass`
+const (
+	MobilePassOff       = "off"       // Wristband credential only
+	MobilePassAlongside = "alongside" // Wristband credential and mobile pass
+	MobilePassOnly      = "only"      // Mobile pass instead of the wristband credential
+)
+
+const mobilePassPrefix = "mobile-"
+
+// IssuesWristband returns true if members are issued a barcode credential
+func (config *Config) IssuesWristband() bool {
+	return config.BrivoMobilePass != MobilePassOnly
+}
+
+// IssuesMobilePass returns true if members are issued a mobile pass
+func (config *Config) IssuesMobilePass() bool {
+	return config.BrivoMobilePass == MobilePassAlongside || config.BrivoMobilePass == MobilePassOnly
+}
+
+// Return the ReferenceID of the user's mobile pass credential
+func (user *BrivoUser) mobilePassRefID() string {
+	return mobilePassPrefix + user.ExternalID
+}
+
+// Return the user's primary email address
+func (user *BrivoUser) primaryEmail() string {
+	if len(user.Emails) == 0 {
+		return ""
+	}
+	return user.Emails[0].Address
+}
+
+// IssueMobilePass sends a Brivo mobile pass invitation to the user's email
+func (user *BrivoUser) IssueMobilePass(brivoAPIKey string, brivoAccessToken string) error {
+	address := user.primaryEmail()
+	if address == "" {
+		return fmt.Errorf("User %s does not have an email address", user.ExternalID)
+	}
+
+	// Build request body JSON
+	bytesMessage, err := json.Marshal(map[string]string{
+		"referenceId": user.mobilePassRefID(),
+		"email":       address,
+		"language":    "en",
+	})
+	if err != nil {
+		return fmt.Errorf("Error building request body json: %s", err)
+	}
+
+	// Create HTTP request
+	req, err := http.NewRequest("POST", fmt.Sprintf("https://api.brivo.com/v1/api/users/%d/credentials/digital-invitation", user.ID), bytes.NewBuffer(bytesMessage))
+	if err != nil {
+		return fmt.Errorf("Error creating HTTP request: %s", err)
+	}
+	req.Header.Add("Content-Type", "application/json")
+	req.Header.Add("Authorization", "Bearer "+brivoAccessToken)
+	req.Header.Add("api-key", brivoAPIKey)
+
+	var r map[string]interface{}
+	if err = utils.DoRequest(req, &r); err != nil {
+		return err
+	}
+
+	fmt.Printf("Mobile pass issued to Brivo user %s at %s\n", user.ExternalID, address)
+	return nil
+}
+
+// RevokeMobilePass deletes the user's mobile pass credential if it exists
+func (user *BrivoUser) RevokeMobilePass(brivoAPIKey string, brivoAccessToken string) error {
+	cred, found, err := findCredentialByRefID(user.mobilePassRefID(), brivoAPIKey, brivoAccessToken)
+	if err != nil {
+		return fmt.Errorf("Error fetching mobile pass for user %s: %s", user.ExternalID, err)
+	}
+	if !found {
+		utils.Logger(fmt.Sprintf("User %s does not have a mobile pass", user.ExternalID))
+		return nil
+	}
+	if err := cred.DeleteCredential(brivoAPIKey, brivoAccessToken); err != nil {
+		return err
+	}
+
+	fmt.Printf("Mobile pass revoked for Brivo user %s\n", user.ExternalID)
+	return nil
+}
+
+// Revoke the existing mobile pass and issue a new one to the user's current email
+func (user *BrivoUser) reissueMobilePass(brivoAPIKey string, brivoAccessToken string) error {
+	if err := user.RevokeMobilePass(brivoAPIKey, brivoAccessToken); err != nil {
+		return err
+	}
+	return user.IssueMobilePass(brivoAPIKey, brivoAccessToken)
+}
@@ -0,0 +1,389 @@
+// Access Eligibility Policies
+//
+// Whether a MINDBODY client has access, and which Brivo groups they are assigned to,
+// is decided by the list of policies configured for each site with `access_policies`.
+// Policies are evaluated in order and the first policy that denies access decides the
+// outcome. Denied users are suspended in Brivo and the reason is stored in the
+// `brivo_reason_field_id` custom field for the front desk. Policies can ask for
+// the decision to be evaluated again later, such as when a hold ends, and a scheduled
+// job syncs those members again when the time has passed.
+
+package models
+
+import (
+	"fmt"
+	"time"
+
+	db "github.com/christophertino/mindbody-brivo"
+	utils "github.com/christophertino/mindbody-brivo"
+	"github.com/gomodule/redigo/redis"
+)
+
+// Access policy names used in `access_policies`
+const (
+	PolicyStatus     = "status"
+	PolicyMembership = "membership"
+	PolicyHousehold  = "household"
+	PolicyWaiver     = "waiver"
+	PolicyHold       = "hold"
+	PolicyBalance    = "balance"
+	PolicyMinor      = "minor"
+	PolicyGroups     = "groups"
+)
+
+const recheckList = "recheck" // Sorted set of MINDBODY barcode IDs scored by the next policy evaluation
+
+// Policy decides whether a MINDBODY client should have access
+type Policy interface {
+	Name() string
+	Evaluate(client *ClientContext) (Decision, error)
+}
+
+// Decision is the result of evaluating one or more policies
+type Decision struct {
+	Allow     bool
+	Reason    string    // Why access was denied
+	Groups    []int     // Brivo groups the member should be assigned to
+	Exclusive bool      // Only assign this decision's groups, ignoring groups from other policies
+	Recheck   time.Time // Evaluate the policies again at this time. Zero if not needed
+
+	Fields     map[int]string // Brivo custom field values keyed by field ID
+	Dependents []string       // MINDBODY barcode IDs whose access depends on this client. Set by decide
+}
+
+// Allow access and assign the member to `groups`
+func allow(groups ...int) Decision {
+	return Decision{Allow: true, Groups: groups}
+}
+
+// Deny access with a reason for the front desk
+func deny(format string, a ...interface{}) Decision {
+	return Decision{Reason: fmt.Sprintf(format, a...)}
+}
+
+// NewPolicy returns the policy for `name`
+func NewPolicy(name string) (Policy, error) {
+	switch name {
+	case PolicyStatus:
+		return statusPolicy{}, nil
+	case PolicyMembership:
+		return membershipPolicy{}, nil
+	case PolicyHousehold:
+		return householdPolicy{}, nil
+	case PolicyWaiver:
+		return waiverPolicy{}, nil
+	case PolicyHold:
+		return holdPolicy{}, nil
+	case PolicyBalance:
+		return balancePolicy{}, nil
+	case PolicyMinor:
+		return minorPolicy{}, nil
+	case PolicyGroups:
+		return groupPolicy{}, nil
+	default:
+		return nil, fmt.Errorf("Unknown access policy %s", name)
+	}
+}
+
+// Returns the policy names for sites that do not set `access_policies`. Optional
+// policies are enabled by their own settings
+func (config *Config) defaultPolicies() []string {
+	names := []string{PolicyStatus}
+	if len(config.HouseholdRelationships) > 0 {
+		names = append(names, PolicyHousehold)
+	}
+	if config.MinorAge > 0 {
+		names = append(names, PolicyMinor)
+	}
+	if config.MindbodyRequireWaiver {
+		names = append(names, PolicyWaiver)
+	}
+	if config.MindbodyContractHolds {
+		names = append(names, PolicyHold)
+	}
+	if config.MindbodyBalanceCheck {
+		names = append(names, PolicyBalance)
+	}
+	return append(names, PolicyGroups)
+}
+
+// Returns the configured policy with `name`, or nil if the site does not use it
+func (config *Config) findPolicy(name string) Policy {
+	for _, policy := range config.AccessPolicies {
+		if policy.Name() == name {
+			return policy
+		}
+	}
+	return nil
+}
+
+// Evaluate decides whether the MINDBODY user should have access using the site's policies
+func (config *Config) Evaluate(mbUser MindBodyUser, auth *Auth) (Decision, error) {
+	return evaluate(config.AccessPolicies, NewClientContext(mbUser, config, auth))
+}
+
+// Evaluate `policies` in order. The first policy that denies access decides the outcome
+func evaluate(policies []Policy, client *ClientContext) (Decision, error) {
+	var (
+		result    = Decision{Allow: true}
+		exclusive []int
+		hasGroups bool
+	)
+	for _, policy := range policies {
+		decision, err := policy.Evaluate(client)
+		if err != nil {
+			return Decision{}, fmt.Errorf("Error evaluating %s policy: %s", policy.Name(), err)
+		}
+		if !decision.Recheck.IsZero() && (result.Recheck.IsZero() || decision.Recheck.Before(result.Recheck)) {
+			result.Recheck = decision.Recheck
+		}
+		for fieldID, value := range decision.Fields {
+			if result.Fields == nil {
+				result.Fields = make(map[int]string)
+			}
+			result.Fields[fieldID] = value
+		}
+		if !decision.Allow {
+			result.Allow = false
+			result.Reason = decision.Reason
+			result.Groups = nil
+			return result, nil
+		}
+		if decision.Exclusive {
+			exclusive = append(exclusive, decision.Groups...)
+			hasGroups = true
+			continue
+		}
+		result.Groups = append(result.Groups, decision.Groups...)
+	}
+	if hasGroups {
+		result.Groups = exclusive
+	}
+	return result, nil
+}
+
+// Evaluate the site's policies for the client and find the dependents whose access
+// depends on it. Dependents are found even when an earlier policy denies access, so
+// they can be synced again whenever the payer's decision changes
+func (client *ClientContext) decide() (Decision, error) {
+	config := client.config
+	decision, err := evaluate(config.AccessPolicies, client)
+	if err != nil {
+		return decision, err
+	}
+	if config.findPolicy(PolicyHousehold) != nil {
+		_, dependents, err := client.Household()
+		if err != nil {
+			return decision, err
+		}
+		decision.Dependents = dependents
+	}
+	return decision, nil
+}
+
+// ClientContext holds the MINDBODY client being evaluated. Data that policies need is
+// fetched from MINDBODY on first use and shared between policies
+type ClientContext struct {
+	Client MindBodyUser
+
+	config      *Config
+	auth        *Auth
+	pool        *redis.Pool // Used to find class bookings. May be nil
+	details     *MindBodyUser
+	memberships *ClientMemberships
+	contracts   *ClientContracts
+}
+
+// NewClientContext creates the context for evaluating policies for `mbUser`
+func NewClientContext(mbUser MindBodyUser, config *Config, auth *Auth) *ClientContext {
+	return &ClientContext{
+		Client: mbUser,
+		config: config,
+		auth:   auth,
+	}
+}
+
+// Details fetches the full MINDBODY client record. Webhook events do not include
+// account balances, liability releases or client indexes
+func (client *ClientContext) Details() (MindBodyUser, error) {
+	if client.details != nil {
+		return *client.details, nil
+	}
+	if err := client.auth.refreshMindBodyToken(*client.config); err != nil {
+		return MindBodyUser{}, err
+	}
+	details, err := GetClient(client.Client.ID, client.config, client.auth.MindBodyToken.AccessToken)
+	if err != nil {
+		return MindBodyUser{}, fmt.Errorf("Error fetching MINDBODY client %s: %s", client.Client.ID, err)
+	}
+	client.details = &details
+	return details, nil
+}
+
+// Memberships fetches the client's active MINDBODY memberships
+func (client *ClientContext) Memberships() ([]ClientMembership, error) {
+	if client.memberships != nil {
+		return client.memberships.ClientMemberships, nil
+	}
+	if err := client.auth.refreshMindBodyToken(*client.config); err != nil {
+		return nil, err
+	}
+	var memberships ClientMemberships
+	if err := memberships.GetActiveMemberships(client.Client.ID, client.config, client.auth.MindBodyToken.AccessToken); err != nil {
+		return nil, fmt.Errorf("Error fetching memberships for user %s: %s", client.Client.ID, err)
+	}
+	client.memberships = &memberships
+	return memberships.ClientMemberships, nil
+}
+
+// Contracts fetches the client's MINDBODY contracts
+func (client *ClientContext) Contracts() ([]ClientContract, error) {
+	if client.contracts != nil {
+		return client.contracts.Contracts, nil
+	}
+	if err := client.auth.refreshMindBodyToken(*client.config); err != nil {
+		return nil, err
+	}
+	var contracts ClientContracts
+	if err := contracts.GetClientContracts(client.Client.ID, client.config, client.auth.MindBodyToken.AccessToken); err != nil {
+		return nil, fmt.Errorf("Error fetching contracts for user %s: %s", client.Client.ID, err)
+	}
+	client.contracts = &contracts
+	return contracts.Contracts, nil
+}
+
+// BookedUntil returns the end of the client's last class or appointment access window.
+// Returns a zero time if the client does not have a booking
+func (client *ClientContext) BookedUntil() (time.Time, error) {
+	if client.config.BrivoClassGroupID == 0 || client.pool == nil {
+		return time.Time{}, nil
+	}
+	return bookedUntil(client.Client.UniqueID, client.config, client.pool)
+}
+
+// Denies access to clients whose MINDBODY status is not active. Class-pack clients with a
+// booking are not suspended, but only have access through the class group
+type statusPolicy struct{}
+
+func (statusPolicy) Name() string { return PolicyStatus }
+
+func (statusPolicy) Evaluate(client *ClientContext) (Decision, error) {
+	if client.Client.IsActive() {
+		return allow(), nil
+	}
+	until, err := client.BookedUntil()
+	if err != nil {
+		return Decision{}, err
+	}
+	if until.After(time.Now()) {
+		decision := allow()
+		decision.Exclusive = true
+		decision.Recheck = until
+		return decision, nil
+	}
+	return deny("MINDBODY status is %s", client.Client.Status), nil
+}
+
+// Denies access to clients without an active MINDBODY membership
+type membershipPolicy struct{}
+
+func (membershipPolicy) Name() string { return PolicyMembership }
+
+func (membershipPolicy) Evaluate(client *ClientContext) (Decision, error) {
+	memberships, err := client.Memberships()
+	if err != nil {
+		return Decision{}, err
+	}
+	if len(memberships) == 0 {
+		return deny("No active MINDBODY membership"), nil
+	}
+	return allow(), nil
+}
+
+// Apply the site's policies to the Brivo user. Denied users are suspended and members
+// whose decision will change are scheduled to be synced again
+func (user *BrivoUser) applyPolicies(client *ClientContext) (Decision, error) {
+	config := client.config
+	decision, err := client.decide()
+	if err != nil {
+		return decision, err
+	}
+
+	// Mapped MINDBODY fields are stored with the fields set by the policies. Access does
+	// not depend on them, so mapping errors are logged and the fields are left alone
+	fields, err := config.mappedFields(client)
+	if err != nil {
+		utils.Logger(fmt.Sprintf("Error mapping custom fields for user %s: %s", user.ExternalID, err))
+	}
+	for fieldID, value := range fields {
+		if decision.Fields == nil {
+			decision.Fields = make(map[int]string)
+		}
+		decision.Fields[fieldID] = value
+	}
+
+	user.Suspended = !decision.Allow
+	if !decision.Allow {
+		fmt.Printf("User %s does not have access: %s\n", user.ExternalID, decision.Reason)
+	}
+	if !decision.Recheck.IsZero() {
+		if err := scheduleRecheck(client.Client.ID, decision.Recheck, config, client.pool); err != nil {
+			return decision, err
+		}
+	}
+	return decision, nil
+}
+
+// ApplyPolicies applies the site's policies to the Brivo user built from `mbUser`. Used
+// by migration, which creates users without SyncUser. `pool` may be nil
+func (user *BrivoUser) ApplyPolicies(mbUser MindBodyUser, config *Config, auth *Auth, pool *redis.Pool) (Decision, error) {
+	client := NewClientContext(mbUser, config, auth)
+	client.pool = pool
+	return user.applyPolicies(client)
+}
+
+// Store the deny reason in the access reason custom field if it has changed
+func (user *BrivoUser) updateAccessReason(current string, reason string, config Config, auth *Auth) error {
+	if config.BrivoReasonFieldID == 0 || current == reason {
+		return nil
+	}
+	if err := user.UpdateCustomField(config.BrivoReasonFieldID, reason, config.BrivoAPIKey, auth.BrivoToken.AccessToken); err != nil {
+		return fmt.Errorf("Error updating custom field for user %s with error: %s", user.ExternalID, err)
+	}
+	return nil
+}
+
+// Store the custom field values set by the policies and field mappings if they have changed
+func (user *BrivoUser) updateFields(current []CustomField, fields map[int]string, config Config, auth *Auth) error {
+	for fieldID, value := range fields {
+		if existing, _ := GetFieldValue(fieldID, current); existing == value {
+			continue
+		}
+		if err := user.UpdateCustomField(fieldID, value, config.BrivoAPIKey, auth.BrivoToken.AccessToken); err != nil {
+			return fmt.Errorf("Error updating custom field for user %s with error: %s", user.ExternalID, err)
+		}
+	}
+	return nil
+}
+
+// Store the member so that their policies are evaluated again at `at`
+func scheduleRecheck(barcodeID string, at time.Time, config *Config, pool *redis.Pool) error {
+	if pool == nil {
+		fmt.Printf("User %s will be checked again by the next webhook or reconciliation\n", barcodeID)
+		return nil
+	}
+
+	conn := pool.Get()
+	defer conn.Close()
+
+	if err := db.ZAdd(config.RedisKey(recheckList), at.UTC().Unix(), barcodeID, conn); err != nil {
+		return fmt.Errorf("Redis: Error storing policy recheck for user %s: %s", barcodeID, err)
+	}
+	return nil
+}
+
+// RecheckPolicies syncs members whose access decision is due to change, such as when
+// a hold ends, a balance is paid or a minor comes of age
+func RecheckPolicies(tenant *Tenant) {
+	resyncDue(tenant, recheckList)
+}
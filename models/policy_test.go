@@ -0,0 +1,88 @@
+package models
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Returns a fixed decision and records that it was evaluated
+type testPolicy struct {
+	decision  Decision
+	evaluated *bool
+}
+
+func (testPolicy) Name() string { return "test" }
+
+func (policy testPolicy) Evaluate(client *ClientContext) (Decision, error) {
+	if policy.evaluated != nil {
+		*policy.evaluated = true
+	}
+	return policy.decision, nil
+}
+
+func TestEvaluate(t *testing.T) {
+	now := time.Now()
+	exclusive := func(groups ...int) Decision {
+		decision := allow(groups...)
+		decision.Exclusive = true
+		return decision
+	}
+	recheck := func(decision Decision, at time.Time) Decision {
+		decision.Recheck = at
+		return decision
+	}
+
+	tests := []struct {
+		name        string
+		decisions   []Decision
+		wantAllow   bool
+		wantReason  string
+		wantGroups  []int
+		wantRecheck time.Time
+		evaluated   int // Number of policies that should be evaluated
+	}{
+		{"allow", []Decision{allow(), allow(1, 2)}, true, "", []int{1, 2}, time.Time{}, 2},
+		{"groups from every policy", []Decision{allow(1), allow(2)}, true, "", []int{1, 2}, time.Time{}, 2},
+		{"deny short-circuits", []Decision{allow(1), deny("Inactive"), allow(2)}, false, "Inactive", nil, time.Time{}, 2},
+		{"first deny wins", []Decision{deny("Inactive"), deny("On hold")}, false, "Inactive", nil, time.Time{}, 1},
+		{"exclusive groups", []Decision{allow(), exclusive(9), allow(1, 2)}, true, "", []int{9}, time.Time{}, 3},
+		{"exclusive without groups", []Decision{exclusive(), allow(1)}, true, "", nil, time.Time{}, 2},
+		{"earliest recheck", []Decision{recheck(allow(), now.Add(time.Hour)), recheck(allow(1), now.Add(time.Minute))}, true, "", []int{1}, now.Add(time.Minute), 2},
+		{"recheck before deny", []Decision{recheck(allow(), now.Add(time.Hour)), recheck(deny("On hold"), now.Add(24*time.Hour))}, false, "On hold", nil, now.Add(time.Hour), 2},
+	}
+
+	for _, test := range tests {
+		var (
+			policies  []Policy
+			evaluated = make([]bool, len(test.decisions))
+		)
+		for i, decision := range test.decisions {
+			policies = append(policies, testPolicy{decision, &evaluated[i]})
+		}
+
+		got, err := evaluate(policies, &ClientContext{})
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", test.name, err)
+			continue
+		}
+		if got.Allow != test.wantAllow || got.Reason != test.wantReason {
+			t.Errorf("%s: expected allow %t %q, got %t %q", test.name, test.wantAllow, test.wantReason, got.Allow, got.Reason)
+		}
+		if !reflect.DeepEqual(got.Groups, test.wantGroups) {
+			t.Errorf("%s: expected groups %v, got %v", test.name, test.wantGroups, got.Groups)
+		}
+		if !got.Recheck.Equal(test.wantRecheck) {
+			t.Errorf("%s: expected recheck %s, got %s", test.name, test.wantRecheck, got.Recheck)
+		}
+		count := 0
+		for _, e := range evaluated {
+			if e {
+				count++
+			}
+		}
+		if count != test.evaluated {
+			t.Errorf("%s: expected %d policies evaluated, got %d", test.name, test.evaluated, count)
+		}
+	}
+}
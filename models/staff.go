@@ -0,0 +1,264 @@
+// MINDBODY Staff Data Model
+//
+// MINDBODY staff are mirrored into Brivo as `Staff` users in the staff group.
+// Staff users use an ExternalID of `staff-<StaffID>` so they never collide with
+// client users keyed by ClientUniqueID.
+
+package models
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/beefsack/go-rate"
+	utils "github.com/christophertino/mindbody-brivo"
+	"github.com/google/go-cmp/cmp"
+)
+
+// Brivo user types stored in the BrivoUserTypeFieldID custom field
+const (
+	UserTypeMember = "Member"
+	UserTypeStaff  = "Staff"
+)
+
+const staffPrefix = "staff-"
+
+// Staff stores MINDBODY staff data
+type Staff struct {
+	PaginationResponse struct {
+		RequestedLimit  int `json:"RequestedLimit"`
+		RequestedOffset int `json:"RequestedOffset"`
+		PageSize        int `json:"PageSize"`
+		TotalResults    int `json:"TotalResults"`
+	} `json:"PaginationResponse"`
+	StaffMembers []StaffMember `json:"StaffMembers"`
+}
+
+// StaffMember stores a single MINDBODY staff member
+type StaffMember struct {
+	ID          int64  `json:"Id"`
+	FirstName   string `json:"FirstName"`
+	LastName    string `json:"LastName"`
+	Email       string `json:"Email"`
+	MobilePhone string `json:"MobilePhone"`
+	HomePhone   string `json:"HomePhone"`
+	WorkPhone   string `json:"WorkPhone"`
+}
+
+// GetStaff builds the MINDBODY staff data model with all active staff members
+func (staff *Staff) GetStaff(config Config, mbAccessToken string) error {
+	var (
+		count   = 0
+		limit   = 200 // Max 200
+		results []StaffMember
+	)
+
+	utils.Logger("Fetching all MINDBODY staff...")
+
+	for {
+		// Create HTTP request
+		req, err := http.NewRequest("GET", fmt.Sprintf("https://api.mindbodyonline.com/public/v6/staff/staff?limit=%d&offset=%d", limit, count), nil)
+		if err != nil {
+			return fmt.Errorf("Error creating HTTP request: %s", err)
+		}
+		req.Header.Add("Content-Type", "application/json")
+		req.Header.Add("SiteId", config.MindbodySite)
+		req.Header.Add("Api-Key", config.MindbodyAPIKey)
+		req.Header.Add("Authorization", mbAccessToken)
+
+		if err = utils.DoRequest(req, staff); err != nil {
+			return err
+		}
+
+		results = append(results, staff.StaffMembers...)
+		count += staff.PaginationResponse.PageSize
+
+		if staff.PaginationResponse.PageSize == 0 || count >= staff.PaginationResponse.TotalResults {
+			break
+		}
+	}
+
+	// Staff missing from the list are suspended, so a partial list must not be used
+	if len(results) < staff.PaginationResponse.TotalResults {
+		return fmt.Errorf("Only fetched %d of %d MINDBODY staff", len(results), staff.PaginationResponse.TotalResults)
+	}
+	staff.StaffMembers = results
+
+	utils.Logger(fmt.Sprintf("Completed fetching %d MINDBODY staff.", len(results)))
+
+	return nil
+}
+
+// IsStaff returns true if the Brivo user was created from a MINDBODY staff member
+func (user *BrivoUser) IsStaff() bool {
+	return strings.HasPrefix(user.ExternalID, staffPrefix)
+}
+
+// BuildStaffUser will build a Brivo user from MINDBODY staff data
+func (user *BrivoUser) BuildStaffUser(staff StaffMember, config Config) {
+	user.ExternalID = staffPrefix + strconv.FormatInt(staff.ID, 10)
+	user.FirstName = staff.FirstName
+	user.LastName = staff.LastName
+	if staff.Email != "" {
+		user.Emails = append(user.Emails, email{
+			Address:   staff.Email,
+			EmailType: "work",
+		})
+	}
+	if staff.HomePhone != "" {
+		user.PhoneNumbers = append(user.PhoneNumbers, phoneNumber{
+			Number:     staff.HomePhone,
+			NumberType: "home",
+		})
+	}
+	if staff.MobilePhone != "" {
+		user.PhoneNumbers = append(user.PhoneNumbers, phoneNumber{
+			Number:     staff.MobilePhone,
+			NumberType: "mobile",
+		})
+	}
+	if staff.WorkPhone != "" {
+		user.PhoneNumbers = append(user.PhoneNumbers, phoneNumber{
+			Number:     staff.WorkPhone,
+			NumberType: "work",
+		})
+	}
+
+	userType := GenerateCustomField(config.BrivoUserTypeFieldID, UserTypeStaff)
+	user.CustomFields = append(user.CustomFields, *userType)
+}
+
+// SyncStaff mirrors all MINDBODY staff into the Brivo staff group. Staff users that
+// are no longer in MINDBODY are suspended, unless the staff list could not be fetched in
+// full. Does nothing if brivo_staff_group_id is not set.
+func SyncStaff(config *Config, auth *Auth, rateLimit *rate.RateLimiter) error {
+	if config.BrivoStaffGroupID == 0 {
+		return nil
+	}
+
+	if err := auth.refreshMindBodyToken(*config); err != nil {
+		return err
+	}
+	var staff Staff
+	if err := staff.GetStaff(*config, auth.MindBodyToken.AccessToken); err != nil {
+		return fmt.Errorf("Error fetching MINDBODY staff: %s", err)
+	}
+
+	// Create or update each staff member
+	active := make(map[string]bool)
+	for _, member := range staff.StaffMembers {
+		var user BrivoUser
+		user.BuildStaffUser(member, *config)
+		active[user.ExternalID] = true
+
+		rateLimit.Wait()
+		if err := user.syncStaffUser(*config, auth); err != nil {
+			fmt.Printf("Error syncing MINDBODY staff %d\n%s\n", member.ID, err)
+		}
+	}
+
+	// An empty staff list is more likely a MINDBODY error than every staff member leaving
+	if len(staff.StaffMembers) == 0 {
+		fmt.Println("No MINDBODY staff found. Skipping staff removals")
+		return nil
+	}
+
+	// Deactivate staff that have been removed from MINDBODY
+	var group Brivo
+	if err := group.ListUsersWithinGroup(config.BrivoStaffGroupID, config.BrivoAPIKey, auth.BrivoToken.AccessToken); err != nil {
+		return fmt.Errorf("Error fetching Brivo staff group: %s", err)
+	}
+	for _, user := range group.Data {
+		if !user.IsStaff() || active[user.ExternalID] || user.Suspended {
+			continue
+		}
+		rateLimit.Wait()
+		if err := user.toggleSuspendedStatus(true, config.BrivoAPIKey, auth.BrivoToken.AccessToken); err != nil {
+			fmt.Printf("Error deactivating staff user %s: %s\n", user.ExternalID, err)
+			continue
+		}
+		if config.IssuesMobilePass() {
+			if err := user.RevokeMobilePass(config.BrivoAPIKey, auth.BrivoToken.AccessToken); err != nil {
+				fmt.Printf("Error revoking mobile pass for staff user %s: %s\n", user.ExternalID, err)
+			}
+		}
+		fmt.Printf("Brivo staff user %s suspended status set to true\n", user.ExternalID)
+	}
+
+	return nil
+}
+
+// Create the staff user in Brivo or update the existing user
+func (user *BrivoUser) syncStaffUser(config Config, auth *Auth) error {
+	var existingUser BrivoUser
+	err := existingUser.getUserByExternalID(user.ExternalID, config.BrivoAPIKey, auth.BrivoToken.AccessToken)
+	switch e := err.(type) {
+	// Staff user already exists: Update user
+	case nil:
+		user.ID = existingUser.ID
+
+		var customFields CustomFields
+		if err := customFields.GetCustomFieldsForUser(user.ID, config.BrivoAPIKey, auth.BrivoToken.AccessToken); err != nil {
+			return fmt.Errorf("Error fetching custom fields for user %s: %s", user.ExternalID, err)
+		}
+		// Only compare the custom fields set on the staff user. The user type is set on creation
+		existingUser.CustomFields = matchingFields(customFields.Data, user.CustomFields)
+
+		if !cmp.Equal(existingUser, *user) {
+			if err := user.updateUser(config.BrivoAPIKey, auth.BrivoToken.AccessToken); err != nil {
+				return fmt.Errorf("Error updating user %s: %s", user.ExternalID, err)
+			}
+			// Handle staff that have been re-added to MINDBODY
+			if existingUser.Suspended {
+				if err := user.toggleSuspendedStatus(false, config.BrivoAPIKey, auth.BrivoToken.AccessToken); err != nil {
+					return fmt.Errorf("Error changing suspended status for user %s: %s", user.ExternalID, err)
+				}
+			}
+			fmt.Printf("Brivo staff user %s updated successfully\n", user.ExternalID)
+		}
+		return user.assignStaffGroup(config, auth)
+	// Staff user does not exist: Create new user
+	case *utils.JSONError:
+		if e.Code != 404 {
+			return err
+		}
+		if err := user.CreateUser(config.BrivoAPIKey, auth.BrivoToken.AccessToken); err != nil {
+			return fmt.Errorf("Error creating user %s with error: %s", user.ExternalID, err)
+		}
+		if err := user.UpdateCustomField(config.BrivoUserTypeFieldID, UserTypeStaff, config.BrivoAPIKey, auth.BrivoToken.AccessToken); err != nil {
+			return fmt.Errorf("Error updating custom field for user %s with error: %s", user.ExternalID, err)
+		}
+		if err := user.assignStaffGroup(config, auth); err != nil {
+			return err
+		}
+		if config.IssuesMobilePass() {
+			if err := user.IssueMobilePass(config.BrivoAPIKey, auth.BrivoToken.AccessToken); err != nil {
+				fmt.Printf("Error issuing mobile pass for user %s with error: %s\n", user.ExternalID, err)
+			}
+		}
+		fmt.Printf("Successfully created Brivo staff user %s\n", user.ExternalID)
+		return nil
+	// General error
+	default:
+		return err
+	}
+}
+
+// Add the staff user to the staff group if they are not already a member
+func (user *BrivoUser) assignStaffGroup(config Config, auth *Auth) error {
+	var groups Groups
+	if err := groups.GetGroupsForUser(user.ID, config.BrivoAPIKey, auth.BrivoToken.AccessToken); err != nil {
+		return fmt.Errorf("Error fetching groups for user %s: %s", user.ExternalID, err)
+	}
+	for _, group := range groups.Data {
+		if group.ID == config.BrivoStaffGroupID {
+			return nil
+		}
+	}
+	if err := user.AssignUserGroup(config.BrivoStaffGroupID, config.BrivoAPIKey, auth.BrivoToken.AccessToken); err != nil {
+		return fmt.Errorf("Error assigning user %s to group %d with error: %s", user.ExternalID, config.BrivoStaffGroupID, err)
+	}
+	return nil
+}
@@ -0,0 +1,204 @@
+// Membership Expiration Sweeper
+//
+// Expired and terminated members only lose access when MINDBODY sends a webhook.
+// The sweeper periodically compares Brivo members with their MINDBODY status and
+// suspends members who are no longer active. A summary of each run is stored in Redis.
+
+package models
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	db "github.com/christophertino/mindbody-brivo"
+	utils "github.com/christophertino/mindbody-brivo"
+	"github.com/gomodule/redigo/redis"
+)
+
+const (
+	sweepList    = "sweeper" // List of SweepSummary json, newest first
+	sweepHistory = 50        // Number of run summaries to keep
+)
+
+// SweepSummary stores the results of a sweeper run
+type SweepSummary struct {
+	Started   time.Time         `json:"started"`
+	Finished  time.Time         `json:"finished"`
+	Checked   int               `json:"checked"`
+	Suspended map[string]string `json:"suspended"` // Reason keyed by ExternalID
+	Errors    map[string]string `json:"errors"`    // Error keyed by ExternalID
+}
+
+// Sweep suspends Brivo members whose MINDBODY status or membership is no longer active
+func Sweep(tenant *Tenant) (*SweepSummary, error) {
+	config := tenant.Config
+	auth := &tenant.Auth
+	summary := SweepSummary{
+		Started:   time.Now().UTC(),
+		Suspended: make(map[string]string),
+		Errors:    make(map[string]string),
+	}
+
+	if err := tenant.RefreshBrivoToken(); err != nil {
+		return nil, err
+	}
+	if err := auth.refreshMindBodyToken(*config); err != nil {
+		return nil, err
+	}
+
+	// Index MINDBODY clients by UniqueID to match Brivo ExternalIDs
+	var mb MindBody
+	if err := mb.GetClients(*config, auth.MindBodyToken.AccessToken); err != nil {
+		return nil, fmt.Errorf("Error fetching MINDBODY clients: %s", err)
+	}
+	// Members missing from the list are suspended, so a partial list must not be used
+	if len(mb.Clients) == 0 || len(mb.Clients) < mb.PaginationResponse.TotalResults {
+		return nil, fmt.Errorf("Only fetched %d of %d MINDBODY clients", len(mb.Clients), mb.PaginationResponse.TotalResults)
+	}
+	clients := make(map[string]MindBodyUser)
+	for _, client := range mb.Clients {
+		clients[strconv.Itoa(client.UniqueID)] = client
+	}
+
+	// Fetch active Brivo users from each facility's member groups
+	var (
+		users []BrivoUser
+		seen  = make(map[int]bool)
+	)
+	for _, groupID := range config.MemberGroupIDs() {
+		var group Brivo
+		if err := group.ListUsersWithinGroup(groupID, config.BrivoAPIKey, auth.BrivoToken.AccessToken); err != nil {
+			return nil, fmt.Errorf("Error fetching Brivo users from group %d: %s", groupID, err)
+		}
+		for _, user := range group.Data {
+			if seen[user.ID] || user.Suspended || user.IsStaff() {
+				continue
+			}
+			seen[user.ID] = true
+			users = append(users, user)
+		}
+	}
+
+	for _, user := range users {
+		// Users created outside of the sync do not have a MINDBODY client ID
+		if _, err := strconv.Atoi(user.ExternalID); err != nil {
+			continue
+		}
+		summary.Checked++
+
+		// Guests keep access until their guest access expires
+		guest, err := hasGuestAccess(user.ID, config, tenant.Pool)
+		if err != nil {
+			summary.Errors[user.ExternalID] = err.Error()
+			continue
+		}
+		if guest {
+			continue
+		}
+
+		if err := tenant.RefreshBrivoToken(); err != nil {
+			return nil, err
+		}
+		tenant.RateLimit.Wait()
+
+		reason, err := config.inactiveReason(user, clients, auth, tenant.Pool)
+		if err != nil {
+			summary.Errors[user.ExternalID] = err.Error()
+			continue
+		}
+		if reason == "" {
+			continue
+		}
+
+		if err := user.toggleSuspendedStatus(true, config.BrivoAPIKey, auth.BrivoToken.AccessToken); err != nil {
+			summary.Errors[user.ExternalID] = fmt.Sprintf("Error suspending user: %s", err)
+			continue
+		}
+		if config.IssuesMobilePass() {
+			if err := user.RevokeMobilePass(config.BrivoAPIKey, auth.BrivoToken.AccessToken); err != nil {
+				summary.Errors[user.ExternalID] = fmt.Sprintf("Error revoking mobile pass: %s", err)
+			}
+		}
+		// Store the deny reason for the front desk, as SyncUser does
+		if err := user.updateAccessReason("", reason, *config, auth); err != nil {
+			summary.Errors[user.ExternalID] = err.Error()
+		}
+		// Dependents share the payer's eligibility, so sync them again
+		if client, ok := clients[user.ExternalID]; ok {
+			if err := recheckDependents(client, config, auth, tenant.Pool); err != nil {
+				summary.Errors[user.ExternalID] = err.Error()
+			}
+		}
+		summary.Suspended[user.ExternalID] = reason
+		fmt.Printf("Brivo user %s suspended by sweeper: %s\n", user.ExternalID, reason)
+	}
+
+	summary.Finished = time.Now().UTC()
+	return &summary, nil
+}
+
+// Returns why the Brivo user should no longer have access, or an empty string if
+// the user is still an active member. `pool` is used to find class bookings
+func (config *Config) inactiveReason(user BrivoUser, clients map[string]MindBodyUser, auth *Auth, pool *redis.Pool) (string, error) {
+	client, ok := clients[user.ExternalID]
+	if !ok {
+		return "MINDBODY client not found", nil
+	}
+
+	policies := []Policy{statusPolicy{}}
+	if config.SweeperRequireMembership {
+		policies = append(policies, membershipPolicy{})
+	}
+	context := NewClientContext(client, config, auth)
+	context.pool = pool
+	decision, err := evaluate(policies, context)
+	if err != nil {
+		return "", err
+	}
+	return decision.Reason, nil
+}
+
+// Save stores the run summary in Redis. Only the most recent runs are kept
+func (summary *SweepSummary) Save(config *Config, pool *redis.Pool) error {
+	conn := pool.Get()
+	defer conn.Close()
+
+	data, err := json.Marshal(summary)
+	if err != nil {
+		return fmt.Errorf("Error building sweep summary json: %s", err)
+	}
+	return db.LPush(config.RedisKey(sweepList), string(data), sweepHistory, conn)
+}
+
+// Log prints the run summary
+func (summary *SweepSummary) Log() {
+	utils.Logger(fmt.Sprintf("Sweeper checked %d members in %s: %d suspended, %d errors",
+		summary.Checked, summary.Finished.Sub(summary.Started).Round(time.Second), len(summary.Suspended), len(summary.Errors)))
+	for id, err := range summary.Errors {
+		fmt.Printf("Sweeper error for user %s: %s\n", id, err)
+	}
+}
+
+// SweepSummaries returns the most recent sweeper run summaries, newest first
+func SweepSummaries(config *Config, pool *redis.Pool) ([]SweepSummary, error) {
+	conn := pool.Get()
+	defer conn.Close()
+
+	values, err := db.LRange(config.RedisKey(sweepList), conn)
+	if err != nil {
+		return nil, err
+	}
+
+	var summaries []SweepSummary
+	for _, value := range values {
+		var summary SweepSummary
+		if err := json.Unmarshal([]byte(value), &summary); err != nil {
+			return nil, fmt.Errorf("Error unmarshalling sweep summary: %s", err)
+		}
+		summaries = append(summaries, summary)
+	}
+
+	return summaries, nil
+}
@@ -0,0 +1,48 @@
+// Tenant Data Model
+//
+// A tenant is a single MINDBODY site and Brivo account. Each tenant has its own
+// configuration, access tokens, rate limit and token refresh state.
+
+package models
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/beefsack/go-rate"
+	"github.com/gomodule/redigo/redis"
+)
+
+// Tenant stores the configuration and runtime state for a single tenant
+type Tenant struct {
+	Config       *Config
+	Auth         Auth
+	Pool         *redis.Pool
+	ErrChan      chan *Event // Events waiting for a token refresh
+	IsRefreshing bool
+	RateLimit    *rate.RateLimiter
+	mu           sync.Mutex
+}
+
+// NewTenant creates a Tenant from `config`. The Redis pool is shared between tenants
+func NewTenant(config *Config, pool *redis.Pool) *Tenant {
+	return &Tenant{
+		Config:    config,
+		Pool:      pool,
+		ErrChan:   make(chan *Event, config.BrivoRateLimit),
+		RateLimit: rate.New(config.BrivoRateLimit, time.Second),
+	}
+}
+
+// SiteID returns the MINDBODY site ID used to route webhook events to the tenant
+func (tenant *Tenant) SiteID() int {
+	siteID, _ := strconv.Atoi(tenant.Config.MindbodySite)
+	return siteID
+}
+
+// RefreshBrivoToken refreshes the tenant's Brivo access token if it has expired. Used
+// by scheduled jobs that call Brivo outside of webhook events
+func (tenant *Tenant) RefreshBrivoToken() error {
+	return tenant.Auth.refreshBrivoToken(*tenant.Config)
+}
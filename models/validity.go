@@ -0,0 +1,149 @@
+// Credential Validity
+//
+// When `credential_contract_dates` is enabled, the effective-to date of a member's
+// credentials is set from their MINDBODY contracts and pricing options. Access ends
+// when the contract ends even if MINDBODY does not send a webhook.
+
+package models
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	utils "github.com/christophertino/mindbody-brivo"
+)
+
+// Returns when the member's access should end. Returns false if the member does not
+// have any current contracts or pricing options
+func (client *ClientContext) accessEndDate() (time.Time, bool, error) {
+	config := client.config
+	contracts, err := client.Contracts()
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	if err := client.auth.refreshMindBodyToken(*config); err != nil {
+		return time.Time{}, false, err
+	}
+	var services ClientServices
+	if err := services.GetClientServices(client.Client.ID, config, client.auth.MindBodyToken.AccessToken); err != nil {
+		return time.Time{}, false, fmt.Errorf("Error fetching pricing options for user %s: %s", client.Client.ID, err)
+	}
+	end, ok := config.accessEnd(contracts, services.ClientServices, time.Now())
+	return end, ok, nil
+}
+
+// Returns the end of the day of the latest current contract or pricing option end date.
+// Expired contracts and pricing options are ignored. Returns a zero time if a current
+// contract or pricing option does not have an end date, and false if there are none
+func (config *Config) accessEnd(contracts []ClientContract, services []ClientService, now time.Time) (time.Time, bool) {
+	var dates []string
+	for _, contract := range contracts {
+		if config.isCurrentContract(contract, now) {
+			dates = append(dates, contract.EndDate)
+		}
+	}
+	for _, service := range services {
+		if config.isCurrentService(service, now) {
+			dates = append(dates, service.ExpirationDate)
+		}
+	}
+	if len(dates) == 0 {
+		return time.Time{}, false
+	}
+
+	var end time.Time
+	for _, date := range dates {
+		t, err := config.parseMindBodyTime(date)
+		if err != nil {
+			// Access does not end
+			return time.Time{}, true
+		}
+		// End dates are inclusive, so access lasts until the end of the day
+		t = t.AddDate(0, 0, 1)
+		if t.After(end) {
+			end = t
+		}
+	}
+	return end, true
+}
+
+// Set the effective-to date of the user's wristband and mobile pass credentials to
+// match the member's MINDBODY contracts. Renewals extend the date and cancellations shorten it.
+// Existing dates are left alone if the member does not have any current contracts or pricing
+// options, and removed if one of them does not end
+func (user *BrivoUser) syncCredentialDates(client *ClientContext) error {
+	config, auth := client.config, client.auth
+	if !config.CredentialContractDates {
+		return nil
+	}
+
+	end, ok, err := client.accessEndDate()
+	if err != nil || !ok {
+		return err
+	}
+
+	var creds CredentialList
+	if err := creds.GetCredentialsForUser(user.ID, config.BrivoAPIKey, auth.BrivoToken.AccessToken); err != nil {
+		return fmt.Errorf("Error fetching credentials for user %s: %s", user.ExternalID, err)
+	}
+	for _, cred := range creds.Data {
+		switch config.CredentialType(cred) {
+		case CredentialWristband, CredentialMobile:
+		default:
+			continue
+		}
+		if sameEffectiveTo(cred.EffectiveTo, end) {
+			continue
+		}
+		if err := user.setCredentialEffectiveTo(cred.ID, end, config.BrivoAPIKey, auth.BrivoToken.AccessToken); err != nil {
+			return fmt.Errorf("Error updating effective date of credential %s for user %s: %s", cred.ReferenceID, user.ExternalID, err)
+		}
+		if end.IsZero() {
+			fmt.Printf("Removed effective-to date of credential %s for user %s\n", cred.ReferenceID, user.ExternalID)
+		} else {
+			fmt.Printf("Set effective-to date of credential %s for user %s to %s\n", cred.ReferenceID, user.ExternalID, end.Format(time.RFC3339))
+		}
+	}
+	return nil
+}
+
+// Compare the credential's effective-to date with `end`. A nil date has no end
+func sameEffectiveTo(current *time.Time, end time.Time) bool {
+	if current == nil {
+		return end.IsZero()
+	}
+	return current.Equal(end)
+}
+
+// Update the effective-to date of the user's credential. A zero time removes the end date
+func (user *BrivoUser) setCredentialEffectiveTo(credID int, effectiveTo time.Time, brivoAPIKey string, brivoAccessToken string) error {
+	body := map[string]interface{}{"effectiveTo": nil}
+	if !effectiveTo.IsZero() {
+		body["effectiveTo"] = effectiveTo.UTC().Format(time.RFC3339)
+	}
+
+	// Build request body JSON
+	bytesMessage, err := json.Marshal(body)
+	if err != nil {
+		return fmt.Errorf("Error building request body json: %s", err)
+	}
+
+	// Create HTTP request
+	req, err := http.NewRequest("PUT", fmt.Sprintf("https://api.brivo.com/v1/api/users/%d/credentials/%d", user.ID, credID), bytes.NewBuffer(bytesMessage))
+	if err != nil {
+		return fmt.Errorf("Error creating HTTP request: %s", err)
+	}
+	req.Header.Add("Content-Type", "application/json")
+	req.Header.Add("Authorization", "Bearer "+brivoAccessToken)
+	req.Header.Add("api-key", brivoAPIKey)
+
+	var r map[string]interface{}
+	if err = utils.DoRequest(req, &r); err != nil {
+		return err
+	}
+
+	return nil
+}
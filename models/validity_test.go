@@ -0,0 +1,41 @@
+package models
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAccessEnd(t *testing.T) {
+	config := &Config{MindbodyTimeZone: time.UTC}
+	now := time.Date(2019, 8, 15, 12, 0, 0, 0, time.UTC)
+
+	annual := ClientContract{StartDate: "2019-01-01T00:00:00", EndDate: "2019-12-31T00:00:00"}
+	autoRenew := ClientContract{StartDate: "2019-01-01T00:00:00"}
+	expired := ClientContract{StartDate: "2018-01-01T00:00:00", EndDate: "2018-12-31T00:00:00"}
+	future := ClientContract{StartDate: "2020-01-01T00:00:00", EndDate: "2020-12-31T00:00:00"}
+	classPack := ClientService{ActiveDate: "2019-08-01T00:00:00", ExpirationDate: "2020-02-01T00:00:00"}
+	oldClassPack := ClientService{ActiveDate: "2017-01-01T00:00:00", ExpirationDate: "2017-06-01T00:00:00"}
+
+	tests := []struct {
+		name      string
+		contracts []ClientContract
+		services  []ClientService
+		wantEnd   time.Time
+		wantOK    bool
+	}{
+		{"no contracts", nil, nil, time.Time{}, false},
+		{"only expired", []ClientContract{expired}, []ClientService{oldClassPack}, time.Time{}, false},
+		{"only future", []ClientContract{future}, nil, time.Time{}, false},
+		{"current contract", []ClientContract{annual, expired}, nil, time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC), true},
+		{"later pricing option", []ClientContract{annual}, []ClientService{classPack}, time.Date(2020, 2, 2, 0, 0, 0, 0, time.UTC), true},
+		{"contract without end date", []ClientContract{autoRenew}, []ClientService{oldClassPack}, time.Time{}, true},
+		{"contract without end date and pricing option", []ClientContract{autoRenew}, []ClientService{classPack}, time.Time{}, true},
+	}
+
+	for _, test := range tests {
+		end, ok := config.accessEnd(test.contracts, test.services, now)
+		if ok != test.wantOK || !end.Equal(test.wantEnd) {
+			t.Errorf("%s: expected %s %t, got %s %t", test.name, test.wantEnd, test.wantOK, end, ok)
+		}
+	}
+}
@@ -0,0 +1,28 @@
+// Liability Waivers
+//
+// The `waiver` policy denies access until the member has signed the MINDBODY liability
+// release. The next `client.updated` webhook or reconciliation after the waiver is
+// signed activates the member.
+
+package models
+
+// Denies access to members who have not signed the liability release
+type waiverPolicy struct{}
+
+func (waiverPolicy) Name() string { return PolicyWaiver }
+
+func (waiverPolicy) Evaluate(client *ClientContext) (Decision, error) {
+	if client.Client.Liability.IsReleased {
+		return allow(), nil
+	}
+
+	// Webhook events do not include the liability release, so fetch the client to be sure
+	details, err := client.Details()
+	if err != nil {
+		return Decision{}, err
+	}
+	if !details.Liability.IsReleased {
+		return deny("Liability waiver has not been signed"), nil
+	}
+	return allow(), nil
+}
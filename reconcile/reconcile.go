@@ -0,0 +1,137 @@
+// Reconcile all MINDBODY clients with their Brivo users
+
+package reconcile
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/beefsack/go-rate"
+	utils "github.com/christophertino/mindbody-brivo"
+	"github.com/christophertino/mindbody-brivo/models"
+	"github.com/gomodule/redigo/redis"
+)
+
+// Creates a log of users synced/failed during reconciliation
+type outputLog struct {
+	success int
+	failed  map[string]string
+	flagged map[string]string // Users with unmanaged credentials
+}
+
+var (
+	auth      models.Auth
+	config    *models.Config
+	pool      *redis.Pool
+	mb        models.MindBody
+	rateLimit *rate.RateLimiter
+	o         outputLog
+)
+
+// Run fetches all MINDBODY clients and syncs each client with a valid barcode ID to
+// Brivo. Existing users are updated and their group memberships are corrected.
+func Run(c *models.Config) {
+	config = c
+
+	// Used to schedule access restoration for members on hold
+	pool = utils.NewPool(config.RedisURL)
+	defer pool.Close()
+
+	if err := auth.Authenticate(config); err != nil {
+		log.Fatalln("Error generating AUTH tokens:", err)
+	}
+	if err := config.LoadCredentialFormat(config.BrivoAPIKey, auth.BrivoToken.AccessToken); err != nil {
+		log.Fatalln("Error loading credential format:", err)
+	}
+	if err := config.LoadGroups(config.BrivoAPIKey, auth.BrivoToken.AccessToken); err != nil {
+		log.Fatalln("Error loading groups:", err)
+	}
+	if err := config.LoadCustomFields(config.BrivoAPIKey, auth.BrivoToken.AccessToken); err != nil {
+		log.Fatalln("Error loading custom fields:", err)
+	}
+
+	// Get all MINDBODY clients
+	if err := mb.GetClients(*config, auth.MindBodyToken.AccessToken); err != nil {
+		log.Fatalln("Error fetching MINDBODY clients", err)
+	}
+
+	// Handle rate limiting. Users are synced one at a time as each sync makes several API calls
+	rateLimit = rate.New(config.BrivoRateLimit, time.Second)
+
+	// Instantiate outputLog failed map
+	o.failed = make(map[string]string)
+	o.flagged = make(map[string]string)
+
+	for _, mbUser := range mb.Clients {
+		// Validate that the ClientID has the correct facility access
+		if _, ok := config.GetFacility(mbUser.ID); !ok {
+			continue
+		}
+		syncUser(mbUser)
+	}
+
+	// Mirror MINDBODY staff into the Brivo staff group
+	if err := models.SyncStaff(config, &auth, rateLimit); err != nil {
+		fmt.Printf("Error syncing MINDBODY staff\n%s\n", err)
+	}
+
+	o.printLog()
+	fmt.Println("Reconciliation completed. See reconcile_output.log")
+}
+
+// Sync a single MINDBODY user to Brivo
+func syncUser(mbUser models.MindBodyUser) {
+	rateLimit.Wait()
+
+	// Check if the Brivo token needs to be refreshed
+	if time.Now().UTC().After(auth.BrivoToken.ExpireTime) {
+		if err := auth.BrivoToken.RefreshBrivoToken(*config); err != nil {
+			log.Fatalf("Failed refreshing Brivo AUTH token with err %s\n", err)
+		}
+		utils.Logger("Refreshed Brivo AUTH token")
+	}
+
+	if err := models.SyncUser(mbUser, *config, &auth, pool); err != nil {
+		fmt.Printf("Error syncing MINDBODY user %d\n%s\n", mbUser.UniqueID, err)
+		o.failed[fmt.Sprint(mbUser.UniqueID)] = err.Error()
+		return
+	}
+	o.success++
+
+	// Flag credentials that were not created by the application so they can be reviewed in Brivo
+	rateLimit.Wait()
+	unmanaged, err := models.UnmanagedCredentials(mbUser, *config, &auth)
+	if err != nil {
+		fmt.Printf("Error checking credentials for MINDBODY user %d\n%s\n", mbUser.UniqueID, err)
+		return
+	}
+	if len(unmanaged) > 0 {
+		var refIDs []string
+		for _, cred := range unmanaged {
+			refIDs = append(refIDs, fmt.Sprintf("%d (%s)", cred.ID, cred.ReferenceID))
+		}
+		o.flagged[fmt.Sprint(mbUser.UniqueID)] = strings.Join(refIDs, ", ")
+	}
+}
+
+// PrintLog generates an output log file for Reconcile app
+func (o *outputLog) printLog() {
+	var b strings.Builder
+	b.WriteString("---------- OUTPUT LOG ----------\n")
+	fmt.Fprintln(&b, "Users Synced Successfully:", o.success)
+	fmt.Fprintln(&b, "Users Failed:", len(o.failed))
+	for index, value := range o.failed {
+		fmt.Fprintf(&b, "External ID: %s Reason: %s\n", index, value)
+	}
+	fmt.Fprintln(&b, "Users With Unmanaged Credentials:", len(o.flagged))
+	for index, value := range o.flagged {
+		fmt.Fprintf(&b, "External ID: %s Credentials: %s\n", index, value)
+	}
+	// Write to file
+	if err := ioutil.WriteFile("reconcile_output.log", []byte(b.String()), 0644); err != nil {
+		log.Fatalln("Error writing output log", err)
+	}
+}
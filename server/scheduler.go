@@ -0,0 +1,36 @@
+// Run background jobs on an interval
+
+package server
+
+import (
+	"fmt"
+	"time"
+
+	db "github.com/christophertino/mindbody-brivo"
+	utils "github.com/christophertino/mindbody-brivo"
+	"github.com/christophertino/mindbody-brivo/models"
+)
+
+// Schedule runs `job` for the tenant every `interval`. A Redis lock is held for
+// the duration of the interval so that only one dyno runs the job at a time.
+func schedule(tenant *models.Tenant, name string, interval time.Duration, job func()) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		conn := tenant.Pool.Get()
+		locked, err := db.SetNX(tenant.Config.RedisKey("lock", name), time.Now().UTC().Format("2006-01-02 15:04:05"), int(interval.Seconds()), conn)
+		conn.Close()
+		if err != nil {
+			fmt.Printf("Redis: Error acquiring lock for job %s: %s\n", name, err)
+			continue
+		}
+		if !locked {
+			utils.Logger(fmt.Sprintf("Job %s is already running on another process", name))
+			continue
+		}
+
+		utils.Logger(fmt.Sprintf("Running scheduled job %s", name))
+		job()
+	}
+}
@@ -12,6 +12,7 @@ import (
 	"log"
 	"net/http"
 	"strings"
+	"time"
 
 	db "github.com/christophertino/mindbody-brivo"
 	utils "github.com/christophertino/mindbody-brivo"
@@ -22,10 +23,9 @@ import (
 )
 
 var (
-	auth         models.Auth
-	pool         *redis.Pool
-	isRefreshing bool
-	errChan      chan *models.Event
+	pool    *redis.Pool
+	tenants = make(map[string]*models.Tenant) // Tenants keyed by TenantKey
+	sites   = make(map[int]*models.Tenant)    // Tenants keyed by MINDBODY site ID
 )
 
 // Launch will start the web server and initialize API routes
@@ -35,16 +35,26 @@ func Launch(config *models.Config) {
 	// Create new Redis connection pool
 	pool = db.NewPool(config.RedisURL)
 
-	// Handle MINDBODY webhook events for client updates
-	router.HandleFunc("/api/v1/user", func(rw http.ResponseWriter, req *http.Request) {
-		// Use wrapper function here so that we can pass `config` to the handler
-		userHandler(rw, req, config)
-	}).Methods(http.MethodPost)
+	// Load the tenant registry
+	configs, err := config.GetTenantConfigs()
+	if err != nil {
+		log.Fatalf("Error loading tenants: %s", err)
+	}
+	for _, c := range configs {
+		tenant := models.NewTenant(c, pool)
+		if _, exists := sites[tenant.SiteID()]; exists {
+			log.Fatalf("MINDBODY site %s is used by more than one tenant", c.MindbodySite)
+		}
+		tenants[c.TenantKey] = tenant
+		sites[tenant.SiteID()] = tenant
+	}
+
+	// Handle MINDBODY webhook events for client updates. Events are routed to a tenant by site ID
+	router.HandleFunc("/api/v1/user", userHandler).Methods(http.MethodPost)
 
-	// Handle Brivo event subscriptions for site access
-	router.HandleFunc("/api/v1/access", func(rw http.ResponseWriter, req *http.Request) {
-		accessHandler(rw, req, config)
-	}).Methods(http.MethodPost)
+	// Handle Brivo event subscriptions for site access. Events are routed to a tenant by URL
+	router.HandleFunc("/api/v1/access", accessHandler).Methods(http.MethodPost)
+	router.HandleFunc("/api/v1/access/{tenant}", accessHandler).Methods(http.MethodPost)
 
 	// Used by MINDBODY to confirm webhook URL is valid
 	router.HandleFunc("/api/v1/user", func(rw http.ResponseWriter, req *http.Request) {
@@ -61,14 +71,98 @@ func Launch(config *models.Config) {
 	server := negroni.New()
 	server.UseHandler(router)
 
-	// Generate access tokens for Brivo and Mindbody
-	if err := auth.Authenticate(config); err != nil {
-		log.Fatalf("Error generating access tokens: %s", err)
-	}
+	for _, tenant := range tenants {
+		// Generate access tokens for Brivo and Mindbody
+		if err := tenant.Auth.Authenticate(tenant.Config); err != nil {
+			log.Fatalf("Error generating access tokens for tenant %s: %s", tenant.Config.TenantKey, err)
+		}
+		if err := tenant.Config.LoadCredentialFormat(tenant.Config.BrivoAPIKey, tenant.Auth.BrivoToken.AccessToken); err != nil {
+			log.Fatalf("Error loading credential format for tenant %s: %s", tenant.Config.TenantKey, err)
+		}
+		if err := tenant.Config.LoadGroups(tenant.Config.BrivoAPIKey, tenant.Auth.BrivoToken.AccessToken); err != nil {
+			log.Fatalf("Error loading groups for tenant %s: %s", tenant.Config.TenantKey, err)
+		}
+		if err := tenant.Config.LoadCustomFields(tenant.Config.BrivoAPIKey, tenant.Auth.BrivoToken.AccessToken); err != nil {
+			log.Fatalf("Error loading custom fields for tenant %s: %s", tenant.Config.TenantKey, err)
+		}
 
-	// Create buffer channel to handle errors from the userHandler
-	errChan = make(chan *models.Event, config.BrivoRateLimit)
-	isRefreshing = false
+		// Retry failed MINDBODY arrivals in the background
+		go func(t *models.Tenant) {
+			schedule(t, "arrivals", time.Minute, func() {
+				models.RetryArrivals(t.Config, &t.Auth, t.Pool)
+			})
+		}(tenant)
+
+		// Remove expired guests from the Brivo guest group
+		if tenant.Config.BrivoGuestGroupID != 0 {
+			go func(t *models.Tenant) {
+				schedule(t, "guests", time.Minute, func() {
+					if err := t.RefreshBrivoToken(); err != nil {
+						fmt.Println(err)
+						return
+					}
+					models.ExpireGuests(t.Config, &t.Auth, t.Pool)
+				})
+			}(tenant)
+		}
+
+		// Open and close class and appointment booking access windows
+		if tenant.Config.BrivoClassGroupID != 0 {
+			go func(t *models.Tenant) {
+				schedule(t, "bookings", time.Minute, func() {
+					if err := t.RefreshBrivoToken(); err != nil {
+						fmt.Println(err)
+						return
+					}
+					models.UpdateAccessWindows(t.Config, &t.Auth, t.Pool)
+				})
+			}(tenant)
+		}
+
+		// Suspend members whose MINDBODY status or membership is no longer active
+		if tenant.Config.SweeperInterval.Duration > 0 {
+			go func(t *models.Tenant) {
+				schedule(t, "sweeper", t.Config.SweeperInterval.Duration, func() {
+					summary, err := models.Sweep(t)
+					if err != nil {
+						fmt.Printf("Error running sweeper for tenant %s: %s\n", t.Config.TenantKey, err)
+						return
+					}
+					summary.Log()
+					if err := summary.Save(t.Config, t.Pool); err != nil {
+						fmt.Printf("Redis: Error storing sweeper summary: %s\n", err)
+					}
+				})
+			}(tenant)
+		}
+
+		// Sync members whose access decision is due to change, such as when a hold ends,
+		// a balance is paid or a minor comes of age
+		go func(t *models.Tenant) {
+			schedule(t, "recheck", time.Minute, func() {
+				if err := t.RefreshBrivoToken(); err != nil {
+					fmt.Println(err)
+					return
+				}
+				models.RecheckPolicies(t)
+			})
+		}(tenant)
+
+		// Mirror MINDBODY staff into the Brivo staff group
+		if tenant.Config.BrivoStaffGroupID != 0 {
+			go func(t *models.Tenant) {
+				schedule(t, "staff", t.Config.StaffSyncInterval.Duration, func() {
+					if err := t.RefreshBrivoToken(); err != nil {
+						fmt.Println(err)
+						return
+					}
+					if err := models.SyncStaff(t.Config, &t.Auth, t.RateLimit); err != nil {
+						fmt.Printf("Error syncing MINDBODY staff for tenant %s: %s\n", t.Config.TenantKey, err)
+					}
+				})
+			}(tenant)
+		}
+	}
 
 	fmt.Printf("Listening for events at PORT %s\n", config.Port)
 
@@ -76,7 +170,7 @@ func Launch(config *models.Config) {
 }
 
 // Handle MINDBODY webhook requests
-func userHandler(rw http.ResponseWriter, req *http.Request, config *models.Config) {
+func userHandler(rw http.ResponseWriter, req *http.Request) {
 	// Handle request
 	body, err := ioutil.ReadAll(req.Body)
 	if err != nil {
@@ -85,15 +179,6 @@ func userHandler(rw http.ResponseWriter, req *http.Request, config *models.Confi
 		return
 	}
 
-	// Validate that the request came from MINDBODY
-	if !config.Debug {
-		if !validateHeader(body, *config, req) {
-			fmt.Println("X-Mindbody-Signature is not present or could not be validated")
-			rw.WriteHeader(http.StatusForbidden)
-			return
-		}
-	}
-
 	// Build request data into Event model
 	var event models.Event
 	if err = json.Unmarshal(body, &event); err != nil {
@@ -102,6 +187,23 @@ func userHandler(rw http.ResponseWriter, req *http.Request, config *models.Confi
 		return
 	}
 
+	// Route the event to the tenant for the MINDBODY site
+	tenant, ok := sites[event.EventData.SiteID]
+	if !ok {
+		fmt.Printf("Tenant not found for MINDBODY site %d\n", event.EventData.SiteID)
+		rw.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	// Validate that the request came from MINDBODY
+	if !tenant.Config.Debug {
+		if !validateHeader(body, *tenant.Config, req) {
+			fmt.Println("X-Mindbody-Signature is not present or could not be validated")
+			rw.WriteHeader(http.StatusForbidden)
+			return
+		}
+	}
+
 	// Respond with 202
 	rw.Header().Set("Content-Type", "application/json")
 	rw.WriteHeader(http.StatusAccepted)
@@ -110,17 +212,25 @@ func userHandler(rw http.ResponseWriter, req *http.Request, config *models.Confi
 	utils.Logger(fmt.Sprintf("EventData payload:\n%+v", event.EventData))
 
 	// Check current refresh status
-	if !isRefreshing {
+	if !tenant.IsRefreshing {
 		// Process the event normally
-		go event.ProcessEvent(errChan, isRefreshing, config, &auth)
+		go event.ProcessEvent(tenant)
 	} else {
 		// A refresh is currently taking place. Push the event into the error channel
-		errChan <- &event
+		tenant.ErrChan <- &event
 	}
 }
 
 // Handle Brivo access requests
-func accessHandler(rw http.ResponseWriter, req *http.Request, config *models.Config) {
+func accessHandler(rw http.ResponseWriter, req *http.Request) {
+	// Route the event to the tenant in the URL. Single tenant setups use an empty key
+	tenant, ok := tenants[mux.Vars(req)["tenant"]]
+	if !ok {
+		fmt.Printf("Tenant %s not found\n", mux.Vars(req)["tenant"])
+		rw.WriteHeader(http.StatusNotFound)
+		return
+	}
+
 	// Handle request
 	body, err := ioutil.ReadAll(req.Body)
 	if err != nil {
@@ -145,7 +255,7 @@ func accessHandler(rw http.ResponseWriter, req *http.Request, config *models.Con
 	utils.Logger(fmt.Sprintf("Access data payload:\n%+v", access))
 
 	// Process the access request
-	access.ProcessRequest(config, &auth, pool)
+	access.ProcessRequest(tenant.Config, &tenant.Auth, tenant.Pool)
 }
 
 // Check for X-Mindbody-Signature header and validate against encoded request body